@@ -0,0 +1,309 @@
+/**
+This source file contains the alerting of channel conditions: source stalls, repeated download failures and write
+failures detected and their recovery, and the webhooks alerts are posted to.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Events posted to webhooks, others are only logged and passed to event handlers.
+var alertEvents = map[string]bool{
+	EVENT_FAILOVER: true,
+	EVENT_FAILBACK: true,
+	EVENT_STALL:    true,
+	EVENT_DOWNLOAD: true,
+	EVENT_WRITE:    true,
+	EVENT_RECOVERY: true,
+}
+
+// alertState is the conditions of a channel, each one is alerted once until it recovers.
+type alertState struct {
+	sync.Mutex
+	lastSegment time.Time // Last time a new segment arrived.
+	stalled     bool
+	failures    int             // Consecutive segment download failures.
+	failing     time.Time       // Since when download failures are alerted, zero if not.
+	writes      map[string]bool // Outputs failing to write, sync/record.
+}
+
+func newAlertState() *alertState {
+	return &alertState{lastSegment: time.Now(), writes: make(map[string]bool)}
+}
+
+// setupAlerts posts events alerted to webhooks, when they are configured.
+func (synchron *Synchronizer) setupAlerts() {
+	synchron.alerts = newAlertState()
+	if n := sharedNotifier(&synchron.option.Alert, synchron.option); nil != n {
+		synchron.OnEvent(n.notify)
+	}
+}
+
+// segmentArrived reports a new segment of playlist, which recovers a stall.
+func (synchron *Synchronizer) segmentArrived() {
+	a := synchron.alerts
+	a.Lock()
+	stalled := time.Now().Sub(a.lastSegment)
+	recovered := a.stalled
+	a.lastSegment, a.stalled = time.Now(), false
+	a.Unlock()
+	if recovered {
+		synchron.emit(EVENT_RECOVERY, map[string]interface{}{
+			"alert":   EVENT_STALL,
+			"seconds": int(stalled.Seconds()),
+		}, "New segment arrived after %s", stalled/time.Second*time.Second)
+	}
+}
+
+// segmentResult reports the result of downloading a segment, after retries and other sources.
+func (synchron *Synchronizer) segmentResult(uri string, err error) {
+	a := synchron.alerts
+	a.Lock()
+	var failures int
+	var since time.Time
+	if nil == err {
+		since = a.failing
+		a.failures, a.failing = 0, time.Time{}
+	} else {
+		a.failures++
+		failures = a.failures
+		if failures == synchron.option.Alert.Failures {
+			a.failing = time.Now()
+		}
+	}
+	a.Unlock()
+	if nil == err && !since.IsZero() {
+		synchron.emit(EVENT_RECOVERY, map[string]interface{}{
+			"alert":   EVENT_DOWNLOAD,
+			"seconds": int(time.Now().Sub(since).Seconds()),
+		}, "Segment downloaded:> %s", uri)
+	} else if nil != err && failures == synchron.option.Alert.Failures {
+		synchron.emit(EVENT_DOWNLOAD, map[string]interface{}{
+			"failures": failures,
+			"uri":      uri,
+			"error":    err.Error(),
+		}, "%d segments failed to download in a row, the last one %s:> %s", failures, uri, err)
+	}
+}
+
+// writeResult reports the result of writing a file of output, sync or record. Failures are reported for any file,
+// while recovery is by segment files written.
+func (synchron *Synchronizer) writeResult(output string, filename string, err error) {
+	a := synchron.alerts
+	a.Lock()
+	failing := a.writes[output]
+	a.writes[output] = nil != err
+	a.Unlock()
+	if nil != err && !failing {
+		synchron.emit(EVENT_WRITE, map[string]interface{}{
+			"output": output,
+			"file":   filename,
+			"error":  err.Error(),
+		}, "Write %s file '%s' failed:> %s", output, filename, err)
+	} else if nil == err && failing {
+		synchron.emit(EVENT_RECOVERY, map[string]interface{}{
+			"alert":  EVENT_WRITE,
+			"output": output,
+			"file":   filename,
+		}, "Wrote %s file '%s'", output, filename)
+	}
+}
+
+// alertProc watches for stalls of source, when no new segment arrives for the stall duration. It ends when polling
+// sources is halted, segments stop arriving then.
+func (synchron *Synchronizer) alertProc() {
+	stall := time.Duration(synchron.option.Alert.Stall) * time.Second
+	if stall <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-synchron.halt:
+			return
+		case <-synchron.quit:
+			return
+		case <-ticker.C:
+		}
+		a := synchron.alerts
+		a.Lock()
+		last := a.lastSegment
+		stalled := !a.stalled && time.Now().Sub(last) >= stall
+		if stalled {
+			a.stalled = true
+		}
+		a.Unlock()
+		if stalled {
+			_, source := synchron.sources.current()
+			synchron.emit(EVENT_STALL, map[string]interface{}{
+				"source":  source,
+				"since":   last,
+				"seconds": int(time.Now().Sub(last).Seconds()),
+			}, "No new segment since %s", last.Format(time.RFC3339))
+		}
+	}
+}
+
+// alertPayload is the JSON body posted to webhooks.
+type alertPayload struct {
+	Type       string                 `json:"type"`
+	Channel    string                 `json:"channel,omitempty"`
+	Host       string                 `json:"host,omitempty"`
+	Message    string                 `json:"message"`
+	Time       time.Time              `json:"time"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+	Suppressed int                    `json:"suppressed,omitempty"` // Alerts dropped by rate limit before this one.
+}
+
+// alertNotifier posts alerts to webhooks in background, as events are emitted with locks held. An alert of the same
+// channel and condition is not repeated within the dedup interval, and alerts beyond the rate are dropped.
+type alertNotifier struct {
+	sync.Mutex
+	webhooks   []string
+	client     *http.Client
+	userAgent  string
+	retries    int
+	dedup      time.Duration
+	rate       int                  // Max alerts per minute, 0 for unlimited.
+	sent       map[string]time.Time // Last time alerts were posted, by channel and condition.
+	window     time.Time            // Start of the current minute of rate limiting.
+	count      int                  // Alerts posted in the current minute.
+	suppressed int                  // Alerts dropped since the last one posted.
+	queue      chan *alertPayload
+	host       string
+}
+
+// Notifier shared by all channels in the process, set by the first channel having webhooks. Channels without webhooks
+// do not post alerts.
+var globalNotifier = struct {
+	sync.Mutex
+	notifier *alertNotifier
+}{}
+
+func sharedNotifier(alert *AlertOption, option *Option) *alertNotifier {
+	if len(alert.Webhooks) < 1 {
+		return nil
+	}
+	globalNotifier.Lock()
+	defer globalNotifier.Unlock()
+	if nil == globalNotifier.notifier {
+		n := &alertNotifier{
+			webhooks:  alert.Webhooks,
+			client:    &http.Client{Timeout: time.Duration(option.Timeout) * time.Second},
+			userAgent: option.UserAgent,
+			retries:   option.Retries,
+			dedup:     time.Duration(alert.Dedup) * time.Second,
+			rate:      alert.Rate,
+			sent:      make(map[string]time.Time),
+			queue:     make(chan *alertPayload, 64),
+		}
+		n.host, _ = os.Hostname()
+		go n.postProc()
+		globalNotifier.notifier = n
+	}
+	return globalNotifier.notifier
+}
+
+// alertCondition identifies the condition of event, recovery is told apart by the condition it recovers.
+func alertCondition(event *Event) string {
+	condition := event.Type
+	if alert, ok := event.Fields["alert"]; ok {
+		condition = fmt.Sprintf("%s:%v", condition, alert)
+	}
+	if output, ok := event.Fields["output"]; ok {
+		condition = fmt.Sprintf("%s:%v", condition, output)
+	}
+	return event.Channel + "|" + condition
+}
+
+// notify queues an event to post, it never blocks.
+func (n *alertNotifier) notify(event *Event) {
+	if !alertEvents[event.Type] {
+		return
+	}
+	n.Lock()
+	now := time.Now()
+	key := alertCondition(event)
+	if last, ok := n.sent[key]; ok && now.Sub(last) < n.dedup {
+		n.Unlock()
+		log.Debugf("Alert [%s] %s deduplicated:> %s \n", event.Type, event.Channel, event.Message)
+		return
+	}
+	if n.rate > 0 {
+		if now.Sub(n.window) >= time.Minute {
+			n.window, n.count = now, 0
+		}
+		if n.count >= n.rate {
+			n.suppressed++
+			n.Unlock()
+			log.Warningf("Alert [%s] %s dropped by rate limit:> %s \n", event.Type, event.Channel, event.Message)
+			return
+		}
+		n.count++
+	}
+	n.sent[key] = now
+	payload := &alertPayload{
+		Type:       event.Type,
+		Channel:    event.Channel,
+		Host:       n.host,
+		Message:    event.Message,
+		Time:       event.Time,
+		Fields:     event.Fields,
+		Suppressed: n.suppressed,
+	}
+	n.suppressed = 0
+	n.Unlock()
+	select {
+	case n.queue <- payload:
+	default:
+		log.Errorf("Alert queue is full, dropped [%s] %s:> %s \n", event.Type, event.Channel, event.Message)
+	}
+}
+
+func (n *alertNotifier) postProc() {
+	for payload := range n.queue {
+		body, e := json.Marshal(payload)
+		if nil != e {
+			log.Errorf("Encode alert failed:> %s \n", e)
+			continue
+		}
+		for _, webhook := range n.webhooks {
+			if e := n.post(webhook, body); nil != e {
+				log.Errorf("Post alert [%s] to '%s' failed:> %s \n", payload.Type, webhook, e)
+			}
+		}
+	}
+}
+
+// post posts an alert to webhook, tried again on failure as many as retries.
+func (n *alertNotifier) post(webhook string, body []byte) (e error) {
+	for i := 0; i <= n.retries; i++ {
+		var req *http.Request
+		if req, e = http.NewRequest("POST", webhook, bytes.NewReader(body)); nil != e {
+			return e
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", n.userAgent)
+		var resp *http.Response
+		if resp, e = n.client.Do(req); nil != e {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			e = fmt.Errorf("received HTTP %d", resp.StatusCode)
+			continue
+		}
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,193 @@
+/**
+This source file contains the HTTP authentication of sources: headers, basic and bearer credentials, cookies and
+query string tokens.
+*/
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// sourceAuth is a SourceAuth with secrets loaded.
+type sourceAuth struct {
+	prefix        string
+	headers       http.Header
+	authorization string
+	cookies       bool
+	tokenParams   []string
+}
+
+// loadSecret returns the value of a secret option, 'env:NAME' reads environment variable NAME and 'file:PATH' reads
+// the content of file PATH, other values are taken as they are.
+func loadSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := value[len("env:"):]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable '%s' is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file:"):
+		data, e := ioutil.ReadFile(value[len("file:"):])
+		if nil != e {
+			return "", e
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return value, nil
+}
+
+func newSourceAuth(option *SourceAuth) (*sourceAuth, error) {
+	auth := &sourceAuth{prefix: option.Prefix, headers: http.Header{}, cookies: option.Cookies, tokenParams: option.TokenParams}
+	for name, value := range option.Headers {
+		v, e := loadSecret(value)
+		if nil != e {
+			return nil, fmt.Errorf("header '%s': %s", name, e)
+		}
+		auth.headers.Set(name, v)
+	}
+	if option.BearerToken != "" {
+		token, e := loadSecret(option.BearerToken)
+		if nil != e {
+			return nil, fmt.Errorf("bearer token: %s", e)
+		}
+		auth.authorization = "Bearer " + token
+	} else if option.Username != "" {
+		password, e := loadSecret(option.Password)
+		if nil != e {
+			return nil, fmt.Errorf("password: %s", e)
+		}
+		auth.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(option.Username+":"+password))
+	}
+	return auth, nil
+}
+
+// setupAuth loads authentication of sources, and a cookie jar for those keeping cookies. The jar is set even if none
+// of them keeps cookies, as authentication may be reloaded.
+func (synchron *Synchronizer) setupAuth() error {
+	auths, e := loadAuths(synchron.option.Source.Auth)
+	if nil != e {
+		return e
+	}
+	synchron.auths = auths
+	jar, _ := cookiejar.New(nil)
+	synchron.client.Jar = &authJar{jar: jar, synchron: synchron}
+	return nil
+}
+
+func loadAuths(options []*SourceAuth) ([]*sourceAuth, error) {
+	var auths []*sourceAuth
+	for i, option := range options {
+		auth, e := newSourceAuth(option)
+		if nil != e {
+			return nil, fmt.Errorf("source auth #%d: %s", i, e)
+		}
+		auths = append(auths, auth)
+	}
+	return auths, nil
+}
+
+// authOf returns the authentication of the longest prefix matching u, nil if none.
+func (synchron *Synchronizer) authOf(u *url.URL) *sourceAuth {
+	var found *sourceAuth
+	s := u.String()
+	synchron.live.RLock()
+	defer synchron.live.RUnlock()
+	for _, auth := range synchron.auths {
+		if strings.HasPrefix(s, auth.prefix) && (nil == found || len(auth.prefix) > len(found.prefix)) {
+			found = auth
+		}
+	}
+	return found
+}
+
+// authorize sets headers and credentials of the source authentication matching the request.
+func (synchron *Synchronizer) authorize(req *http.Request) {
+	auth := synchron.authOf(req.URL)
+	if nil == auth {
+		return
+	}
+	for name, values := range auth.headers {
+		req.Header[name] = values
+	}
+	if auth.authorization != "" {
+		req.Header.Set("Authorization", auth.authorization)
+	}
+}
+
+// withTokens propagates token parameters of the playlist URL base to uri, which is resolved from the playlist.
+// Parameters uri already has are kept. Parameters are appended as they are in base, while uri is kept byte for byte:
+// CDNs may sign the query as it is.
+func (synchron *Synchronizer) withTokens(base *url.URL, uri string) string {
+	auth := synchron.authOf(base)
+	if nil == auth || len(auth.tokenParams) < 1 {
+		return uri
+	}
+	u, e := url.Parse(uri)
+	if nil != e {
+		return uri
+	}
+	q := u.Query()
+	var pairs []string
+	for _, pair := range strings.Split(base.RawQuery, "&") {
+		name := pair
+		if i := strings.Index(pair, "="); i >= 0 {
+			name = pair[:i]
+		}
+		if name, e = url.QueryUnescape(name); nil != e || q.Get(name) != "" {
+			continue
+		}
+		for _, param := range auth.tokenParams {
+			if param == name {
+				pairs = append(pairs, pair)
+				break
+			}
+		}
+	}
+	if len(pairs) < 1 {
+		return uri
+	}
+	fragment := ""
+	if i := strings.Index(uri, "#"); i >= 0 {
+		uri, fragment = uri[:i], uri[i:]
+	}
+	switch {
+	case !strings.Contains(uri, "?"):
+		uri += "?"
+	case !strings.HasSuffix(uri, "?") && !strings.HasSuffix(uri, "&"):
+		uri += "&"
+	}
+	return uri + strings.Join(pairs, "&") + fragment
+}
+
+// authJar keeps cookies of sources whose authentication enables cookies only.
+type authJar struct {
+	jar      http.CookieJar
+	synchron *Synchronizer
+}
+
+func (j *authJar) enabled(u *url.URL) bool {
+	auth := j.synchron.authOf(u)
+	return nil != auth && auth.cookies
+}
+
+func (j *authJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if j.enabled(u) {
+		j.jar.SetCookies(u, cookies)
+	}
+}
+
+func (j *authJar) Cookies(u *url.URL) []*http.Cookie {
+	if j.enabled(u) {
+		return j.jar.Cookies(u)
+	}
+	return nil
+}
@@ -4,10 +4,16 @@ This source file defines the config options.
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
 
 	"github.com/BurntSushi/toml"
-	//"fmt"
+	log "github.com/Sirupsen/logrus"
 )
 
 type SyncOption struct {
@@ -18,6 +24,12 @@ type SyncOption struct {
 	ReSegment   bool
 	RemoveOld   bool
 	CleanFolder bool
+	// Target duration of segments re-cut in seconds, 0 for the target duration of source.
+	ReSegmentDuration int
+	// Keep segments of AES-128 encrypted sources encrypted, the synced playlist refers to keys of source.
+	KeepEncrypted bool
+	// Republish partial segments of Low-Latency HLS sources in the synced playlist.
+	LowLatency bool
 }
 
 type RecordOption struct {
@@ -35,6 +47,74 @@ type RecordOption struct {
 
 type SourceOption struct {
 	Urls []string
+	// Master playlist options -----------------------
+	VariantPolicy     string // highest/lowest/resolution/codecs/index
+	VariantResolution string // eg: 1280x720, used by policy 'resolution'
+	VariantCodecs     string // eg: avc1,mp4a, used by policy 'codecs'
+	VariantIndex      int    // used by policy 'index'
+	MasterRefresh     int    // Re-resolve master playlist interval in seconds.
+	Ladder            bool   // Follow all variants and renditions of master playlist.
+	// Failover options ------------------------------
+	FailoverScore int // Switch to the best backup when health score of active source is below it (0-100).
+	FailbackAfter int // Switch back to primary source after it is healthy for seconds, 0 to disable.
+	ProbeInterval int // Interval in seconds of probing inactive sources, 0 to disable.
+	// Redundant options -----------------------------
+	Mode    string // failover/redundant
+	AlignBy string // program/sequence, how segments of redundant sources are aligned.
+	// Deduplication options -------------------------
+	DedupBy string // sequence/path/uri, how segments are told apart across playlist updates, except in redundant mode.
+	// Authentication options ------------------------
+	Auth        []*SourceAuth
+	Resolver    string // Command or local http(s) endpoint returning fresh source URLs, like newly signed ones.
+	ExpiryParam string // Query parameter of source URLs holding the unix time their signature expires, eg: expires.
+	// Network options -------------------------------
+	Network []*SourceNetwork
+}
+
+// SourceAuth is the HTTP authentication of requests to sources. Header values, password and bearer token may be given
+// as 'env:NAME' or 'file:PATH' to load them from environment variables or files instead.
+type SourceAuth struct {
+	Prefix      string            // Applies to URLs of playlists, segments and keys starting with it, empty for all.
+	Headers     map[string]string // Extra request headers, eg: Referer, Origin.
+	Username    string            // Basic authentication.
+	Password    string
+	BearerToken string
+	Cookies     bool     // Keep cookies set by source and send them back.
+	TokenParams []string // Query parameters of playlist URL propagated to segment and key URLs, eg: token.
+}
+
+// SourceNetwork is the outbound network of requests to sources.
+type SourceNetwork struct {
+	Prefix    string            // Applies to URLs of playlists, segments and keys starting with it, empty for all.
+	Proxy     string            // eg: http://proxy:3128, socks5://proxy:1080. Default empty means by environment.
+	CAFile    string            `toml:"ca_file"`   // Extra CA certificates in PEM, trusted along with system ones.
+	CertFile  string            `toml:"cert_file"` // Client certificate and key in PEM, for mutual TLS.
+	KeyFile   string            `toml:"key_file"`
+	Insecure  bool              // Skip verifying server certificates.
+	LocalAddr string            `toml:"local_addr"` // Local IP address or network interface name to bind.
+	Resolve   map[string]string // Static resolving of 'host' or 'host:port' to IP address.
+}
+
+type DownloadOption struct {
+	// Download Options ------------------------------
+	Workers int // Max segments downloading in parallel.
+	PerHost int // Max segments downloading in parallel from the same host, shared by all channels.
+	// Max download rate of segments in kbit/s, 0 for unlimited.
+	RateLimit       int // Of the channel.
+	GlobalRateLimit int // Shared by all channels, set by the first channel.
+	CatchUp         int // Spread downloads of segments behind live edge over seconds, 0 to download at once.
+	// Segments are validated by Content-Length and container, and checked optionally that the PTS span of TS
+	// segments matches their duration. Invalid segments are downloaded again and listed as gaps at last.
+	CheckDuration bool
+	Backfill      int // Max segments missing in a gap to backfill, 0 to disable.
+}
+
+type EncryptOption struct {
+	// Encrypt Options -------------------------------
+	Method      string // AES-128/SAMPLE-AES, empty to disable.
+	KeyDir      string // Directory of keys, default 'keys' in record output (or sync output).
+	KeyUri      string // URI prefix of keys in playlists, default relative paths of key files.
+	RotateEvery int    // Rotate key every N segments, 0 to use one key for each run.
 }
 
 type HttpOption struct {
@@ -47,6 +127,15 @@ type HttpOption struct {
 	CacheValid    int    // Cache valid duration in seconds.
 }
 
+type AlertOption struct {
+	// Alert Options ---------------------------------
+	Webhooks []string // URLs alerts are posted to in JSON, empty to disable.
+	Stall    int      // Alert when no new segment arrives for seconds, 0 to disable.
+	Failures int      // Alert after segments failed to download in a row, 0 to disable.
+	Dedup    int      // Seconds an alert of the same channel and condition is not repeated.
+	Rate     int      // Max alerts per minute, shared by all channels, 0 for unlimited.
+}
+
 type Option struct {
 	// Global Options --------------------------------
 	LogFile           string
@@ -61,6 +150,11 @@ type Option struct {
 	TargetDuration    int
 	ProgramTimeFormat string
 	ProgramTimezone   string
+	RestartDelay      int    // Initial delay in seconds before restarting a crashed channel.
+	RestartMaxDelay   int    // Max delay in seconds of restarting backoff.
+	StateFile         string // Capture state file name in output directory, empty to disable.
+	ShutdownTimeout   int    // Seconds to deliver segments queued on SIGTERM/SIGINT before stopping at once.
+	GapLog            string // Gap log file name in output directory, empty to disable.
 
 	// Sync Option
 	Sync SyncOption
@@ -68,8 +162,21 @@ type Option struct {
 	Record RecordOption
 	// Source URLs.
 	Source SourceOption
+	// Download Option
+	Download DownloadOption
+	// Encrypt Option
+	Encrypt EncryptOption
 	// Http Service
 	Http HttpOption
+	// Alerting
+	Alert AlertOption
+	// Channels, each one inherits global options and overrides its own.
+	Channels []*ChannelOption `toml:"-"`
+}
+
+type ChannelOption struct {
+	Name string
+	Option
 }
 
 func CheckConfiguration(option *Option, output io.Writer) {
@@ -83,6 +190,10 @@ func CheckConfiguration(option *Option, output io.Writer) {
 	}
 	_print("\n")
 	toml.NewEncoder(output).Encode(option)
+	for _, channel := range option.Channels {
+		_print("\n[[channel]]\n")
+		toml.NewEncoder(output).Encode(channel)
+	}
 	//_print(fmt.Sprintf("LogFile: %s\n", option.LogFile))
 	//_print(fmt.Sprintf("LogLevel: %s\n", option.LogLevel))
 	//_print(fmt.Sprintf("Timeout: %d\n", option.Timeout))
@@ -123,7 +234,126 @@ func CheckConfiguration(option *Option, output io.Writer) {
 	_print("Configuration validated!\n")
 }
 
+// optionKey makes keys of options comparable regardless of case and underscores, eg: LogLevel and log_level.
+func optionKey(key string) string {
+	return strings.ToLower(strings.Replace(key, "_", "", -1))
+}
+
+// optionFields returns the fields of struct type t by their option keys, with fields of embedded structs.
+func optionFields(t reflect.Type, fields map[string]reflect.StructField) map[string]reflect.StructField {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("toml")
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			optionFields(f.Type, fields)
+		} else if tag != "-" && f.PkgPath == "" {
+			fields[optionKey(f.Name)] = f
+			if tag != "" {
+				fields[optionKey(tag)] = f
+			}
+		}
+	}
+	return fields
+}
+
+// mapOptionKeys renames keys of table to the keys fields of struct type t are decoded by, so that options are given
+// by their names in any case or in snake_case, eg: MaxSegments, maxsegments or max_segments. Unknown keys are kept.
+func mapOptionKeys(table map[string]interface{}, t reflect.Type) map[string]interface{} {
+	fields := optionFields(t, make(map[string]reflect.StructField))
+	mapped := make(map[string]interface{}, len(table))
+	for key, value := range table {
+		f, ok := fields[optionKey(key)]
+		if !ok {
+			mapped[key] = value
+			continue
+		}
+		key = f.Name
+		if tag := f.Tag.Get("toml"); tag != "" {
+			key = tag
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr || ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				value = mapOptionKeys(v, ft)
+			case []map[string]interface{}:
+				for i := range v {
+					v[i] = mapOptionKeys(v[i], ft)
+				}
+			}
+		}
+		mapped[key] = value
+	}
+	return mapped
+}
+
 func LoadConfiguration(filename string, option *Option) (e error) {
-	_, e = toml.DecodeFile(filename, option)
+	var table map[string]interface{}
+	if _, e = toml.DecodeFile(filename, &table); nil != e {
+		return e
+	}
+	table = mapOptionKeys(table, reflect.TypeOf(struct {
+		Option
+		Channel []*ChannelOption
+	}{}))
+	buf := &bytes.Buffer{}
+	if e = toml.NewEncoder(buf).Encode(table); nil != e {
+		return e
+	}
+	config := struct {
+		Option
+		Channel []toml.Primitive
+	}{Option: *option}
+	md, e := toml.Decode(buf.String(), &config)
+	if nil != e {
+		return e
+	}
+	*option = config.Option
+	names := make(map[string]bool)
+	for i, primitive := range config.Channel {
+		channel := &ChannelOption{Option: *option}
+		channel.Source.Urls = nil
+		channel.Channels = nil
+		if e = md.PrimitiveDecode(primitive, channel); nil != e {
+			return fmt.Errorf("channel #%d: %s", i, e)
+		}
+		if channel.Name == "" {
+			return fmt.Errorf("channel #%d: name is required", i)
+		} else if names[channel.Name] {
+			return fmt.Errorf("channel '%s': duplicated name", channel.Name)
+		} else if len(channel.Source.Urls) < 1 {
+			return fmt.Errorf("channel '%s': at least one source URL is required", channel.Name)
+		}
+		names[channel.Name] = true
+		// Channels not overriding outputs are stored in sub-folders named after them.
+		if channel.Sync.Output == option.Sync.Output {
+			channel.Sync.Output = filepath.Join(option.Sync.Output, channel.Name)
+		}
+		if channel.Record.Output == option.Record.Output {
+			channel.Record.Output = filepath.Join(option.Record.Output, channel.Name)
+		}
+		// Logging and HTTP listener are shared by all channels.
+		channel.LogFile = option.LogFile
+		channel.LogLevel = option.LogLevel
+		channel.Http.Listen = option.Http.Listen
+		option.Channels = append(option.Channels, channel)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		log.Warningf("Unknown options ignored:> %s \n", strings.Join(keys, ", "))
+	}
+	if len(option.Channels) > 0 && option.Http.Enabled {
+		for _, channel := range option.Channels {
+			if channel.Http.Enabled && (!channel.Record.Enabled || !channel.Record.Reindex) {
+				return errors.New("record and reindex should be enabled for channels with HTTP service")
+			}
+		}
+	}
 	return e
 }
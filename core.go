@@ -5,6 +5,7 @@ package main
 
 import (
     "bytes"
+    "context"
     "errors"
     "io/ioutil"
     "net/http"
@@ -18,6 +19,7 @@ import (
     //"net/url"
     "fmt"
     "os"
+    "runtime/debug"
 
     "github.com/archsh/go.timefmt"
 )
@@ -26,14 +28,52 @@ type Synchronizer struct {
     option           *Option
     client           *http.Client
     program_timezone *time.Location
-    httpCache        *lru.Cache
+    httpCache        *playlistCache
     sourceCrc16      string
+    renditions       []*rendition
+    clock            *ladderClock
+    variant          bool // Ladder rendition of EXT-X-STREAM-INF, others are aligned with.
+    quit             chan struct{}
+    quitOnce         sync.Once
+    halt             chan struct{} // Closed to stop polling sources, segments queued are still delivered.
+    haltOnce         sync.Once
+    ctx              context.Context // Cancelled on stop, requests are bound to it.
+    cancel           context.CancelFunc
+    pollCtx          context.Context // Cancelled on shutdown too, requests polling sources are bound to it.
+    pollCancel       context.CancelFunc
+    downloadSlots    chan struct{}
+    sources          *sourceSet
+    alternates       *alternateSet
+    dedupBy          DedupBy
+    keys             *keyCache
+    inits            *initSet
+    gaps             *lru.Cache // Segments failed to download by local URI, listed as gaps.
+    gapLog           *gapLog
+    alerts           *alertState
+    state            *stateFile // Capture state kept across restarts, nil if disabled.
+    auths            []*sourceAuth
+    live             sync.RWMutex // Guards options applied by Reload, and auths.
+    resolver         SourceResolver
+    limiter          *rateLimiter // Download rate limit of channel.
+    encryptor        *encryptor
+    name             string
+    eventLock        sync.Mutex
+    eventHandlers    []EventHandler
 }
 
 type SegmentMessage struct {
     _type            SyncType
     _hit             bool
     _target_duration float64
+    _source          int
+    _key             string // Segment key of deduplication and alignment across sources.
+    _crypt           *segmentCrypt
+    _map             *initSection
+    _discontinuity   uint64 // Discontinuity sequence of playlist, or of segment.
+    _part            *partialSegment
+    _parts           *lowLatency // Partial segments republished with playlist.
+    _gap             *GapEntry   // Gap the segment is backfilled of.
+    _behind          int         // Segments after it in playlist.
     playlist         *m3u8.MediaPlaylist
     segment          *m3u8.MediaSegment
     response         *http.Response
@@ -47,6 +87,47 @@ func NewSynchronizer(option *Option) (s *Synchronizer, e error) {
     s.option = option
     s.client = &http.Client{Timeout: time.Duration(option.Timeout) * time.Second}
     s.sourceCrc16 = fmt.Sprintf("%04x", CRC16([]byte(option.Source.Urls[0])))
+    s.httpCache = newPlaylistCache(option.Http.CacheNum)
+    s.quit = make(chan struct{})
+    s.halt = make(chan struct{})
+    s.ctx, s.cancel = context.WithCancel(context.Background())
+    s.pollCtx, s.pollCancel = context.WithCancel(s.ctx)
+    s.downloadSlots = make(chan struct{}, s.workers())
+    s.sources = newSourceSet(s, option.Source.Urls)
+    s.keys = newKeyCache()
+    s.inits = newInitSet(option.MaxSegments)
+    s.gaps = lru.New(option.MaxSegments * 2)
+    s.setupState()
+    s.setupGapLog()
+    s.setupAlerts()
+    s.limiter = newRateLimiter(option.Download.RateLimit)
+    if e = s.setupAuth(); nil != e {
+        return nil, e
+    }
+    s.setupResolver()
+    if e = s.setupNetwork(); nil != e {
+        return nil, e
+    }
+    if _, e = parseVariantPolicy(option.Source.VariantPolicy); nil != e {
+        return nil, e
+    }
+    if method, e := parseEncryptMethod(option.Encrypt.Method); nil != e {
+        return nil, e
+    } else if method != "" {
+        s.encryptor = s.newEncryptor(method)
+    }
+    if mode, e := parseSourceMode(option.Source.Mode); nil != e {
+        return nil, e
+    } else if mode == SM_REDUNDANT {
+        if alignBy, e := parseAlignBy(option.Source.AlignBy); nil != e {
+            return nil, e
+        } else {
+            s.alternates = newAlternateSet(alignBy, option.MaxSegments*4)
+        }
+    }
+    if s.dedupBy, e = parseDedupBy(option.Source.DedupBy); nil != e {
+        return nil, e
+    }
     if s.program_timezone, e = time.LoadLocation(option.ProgramTimezone); nil != e {
         return nil, e
     //} else {
@@ -60,9 +141,6 @@ func NewSynchronizer(option *Option) (s *Synchronizer, e error) {
 
 func (synchron *Synchronizer) Run() {
     log.Infoln("Synchronizer.Run > Starting hls-sync ...")
-    syncChan := make(chan *SyncMessage, 20)
-    recordChan := make(chan *RecordMessage, 20)
-    segmentChan := make(chan *SegmentMessage, 20)
     //m3u8.ProgramTimeFormat = synchron.option.ProgramTimeFormat
     //m3u8.ProgramTimeLocation = synchron.program_timezone
     if synchron.option.Http.Enabled {
@@ -71,263 +149,732 @@ func (synchron *Synchronizer) Run() {
             os.Exit(1)
         }
     }
-    var wg sync.WaitGroup
+    if synchron.option.Source.Ladder {
+        synchron.runLadder()
+        return
+    }
+    syncChan := make(chan *SyncMessage, 20)
+    recordChan := make(chan *RecordMessage, 20)
+    segmentChan := make(chan *SegmentMessage, 20)
+    // Processes of the pipeline end in turn when polling is halted, services are stopped after them.
+    var wg, services sync.WaitGroup
     wg.Add(1)
     go func() {
-        synchron.playlistProc(segmentChan)
+        synchron.guard("playlistProc", func() { synchron.playlistProc(segmentChan) })
         wg.Done()
     }()
+    services.Add(1)
+    go func() {
+        synchron.guard("probeProc", synchron.probeProc)
+        services.Done()
+    }()
+    services.Add(1)
+    go func() {
+        synchron.guard("alertProc", synchron.alertProc)
+        services.Done()
+    }()
     wg.Add(1)
     go func() {
-        synchron.segmentProc(segmentChan, syncChan, recordChan)
+        synchron.guard("segmentProc", func() { synchron.segmentProc(segmentChan, syncChan, recordChan) })
         wg.Done()
     }()
     if synchron.option.Sync.Enabled {
         wg.Add(1)
         go func() {
-            synchron.syncProc(syncChan)
+            synchron.guard("syncProc", func() { synchron.syncProc(syncChan) })
             wg.Done()
         }()
     }
     if synchron.option.Record.Enabled {
         wg.Add(1)
         go func() {
-            synchron.recordProc(recordChan)
+            synchron.guard("recordProc", func() { synchron.recordProc(recordChan) })
             wg.Done()
         }()
     }
     if synchron.option.Http.Enabled {
-        wg.Add(1)
+        services.Add(1)
         go func() {
             synchron.HttpServe()
-            wg.Done()
+            services.Done()
         }()
     }
     wg.Wait()
+    synchron.Stop()
+    services.Wait()
 }
 
-func (synchron *Synchronizer) playlistProc(segmentChan chan *SegmentMessage) {
-    cache := lru.New(synchron.option.MaxSegments)
-    retry := 0
-    timezone_shift := time.Minute * time.Duration(synchron.option.TimezoneShift)
-    timestamp_type := TST_LOCAL
+// Shutdown stops polling sources and lets segments queued be downloaded and delivered, Run returns when they are.
+// The synchronizer is stopped at once when they are not done within timeout.
+func (synchron *Synchronizer) Shutdown(timeout time.Duration) {
+    synchron.haltOnce.Do(func() {
+        close(synchron.halt)
+        synchron.pollCancel()
+        go func() {
+            select {
+            case <-time.After(timeout):
+                log.Warningf("Shutdown timed out after %s, stopping at once.\n", timeout)
+                synchron.Stop()
+            case <-synchron.quit:
+            }
+        }()
+    })
+    for _, r := range synchron.renditions {
+        if r.synchron != nil {
+            r.synchron.Shutdown(timeout)
+        }
+    }
+}
+
+// Stop asks all processes of the synchronizer to quit.
+func (synchron *Synchronizer) Stop() {
+    synchron.quitOnce.Do(func() {
+        close(synchron.quit)
+        synchron.cancel()
+    })
+    for _, r := range synchron.renditions {
+        if r.synchron != nil {
+            r.synchron.Stop()
+        }
+    }
+}
+
+func (synchron *Synchronizer) stopped() bool {
+    select {
+    case <-synchron.quit:
+        return true
+    default:
+        return false
+    }
+}
+
+// halted tells if polling sources should end, on shutdown or stop.
+func (synchron *Synchronizer) halted() bool {
+    select {
+    case <-synchron.halt:
+        return true
+    default:
+        return synchron.stopped()
+    }
+}
+
+// guard runs a process and stops the synchronizer when the process crashed, so that Run returns.
+func (synchron *Synchronizer) guard(name string, proc func()) {
+    defer func() {
+        if r := recover(); r != nil {
+            log.Errorf("%s crashed:> %v \n%s", name, r, debug.Stack())
+            synchron.Stop()
+        }
+    }()
+    proc()
+}
+
+// playlistState keeps the timestamps of known segments across playlist updates.
+type playlistState struct {
+    cache            *lru.Cache
+    timezone_shift   time.Duration
+    timestamp_type   TimeStampType
+    last_new_segment time.Time
+    parts            *lru.Cache // Partial segments synced, keyed by URI and byte range on source.
+    origin           string // URL of the playlist new segments came from last.
+    discontinuity    uint64 // Discontinuity sequence number of the last new segment.
+    position         *sequencePosition // Position of the first segment of last playlist by numbering of source.
+    end              *streamEnd        // Last segment of last playlist, to detect gaps.
+}
+
+// knownSegment is what is kept of a segment between playlist updates.
+type knownSegment struct {
+    timestamp     time.Time
+    discontinuity bool
+    sequence      uint64 // Discontinuity sequence number.
+}
+
+func (synchron *Synchronizer) newPlaylistState() *playlistState {
+    state := &playlistState{
+        cache:            lru.New(synchron.option.MaxSegments),
+        timezone_shift:   time.Minute * time.Duration(synchron.option.TimezoneShift),
+        timestamp_type:   TST_LOCAL,
+        last_new_segment: time.Now(),
+        parts:            lru.New(synchron.option.MaxSegments * 8),
+    }
     switch strings.ToLower(synchron.option.TimestampType) {
     case "local":
-        timestamp_type = TST_LOCAL
+        state.timestamp_type = TST_LOCAL
     case "segment":
-        timestamp_type = TST_SEGMENT
+        state.timestamp_type = TST_SEGMENT
     default:
-        timestamp_type = TST_PROGRAM
-    }
-    src_idx := 0
-    last_new_segment := time.Now()
-    for {
-        if retry >= synchron.option.Retries {
-            if len(synchron.option.Source.Urls) > (src_idx + 1) {
-                src_idx += 1
-                retry = 0
-            } else if src_idx > 0 {
-                src_idx = 0
-                retry = 0
+        state.timestamp_type = TST_PROGRAM
+    }
+    synchron.restorePosition(state, synchron.state.restore(state))
+    return state
+}
+
+func (synchron *Synchronizer) playlistProc(segmentChan chan *SegmentMessage) {
+    state := synchron.newPlaylistState()
+    // Close segment message channel.
+    defer close(segmentChan)
+    if synchron.alternates != nil {
+        synchron.redundantProc(state, segmentChan)
+        return
+    }
+    // Variants followed for sources which are master playlists, keyed by source URL.
+    variants := make(map[string]*resolvedVariant)
+    var ll *lowLatency
+    timers := make(reloadTimers)
+    for !synchron.halted() {
+        src_idx, _ := synchron.sources.current()
+        srcUrl := synchron.sourceURL(src_idx)
+        timer := timers.get(src_idx)
+        timer.start()
+        blocking := nil != ll && ll.canBlockReload
+        mpl, resp, loaded, seq, err := synchron.loadPlaylist(synchron.pollCtx, srcUrl, variants, ll)
+        ll = loaded
+        if err != nil {
+            log.Errorln("Load playlist failed:> ", err)
+            synchron.sourceDenied(src_idx, err)
+            delay := timer.failed()
+            synchron.sources.polled(src_idx, false, blocking, err, delay)
+            synchron.sources.playlistFailed(src_idx)
+            synchron.pause(delay)
+            continue
+        }
+        changed := timer.loaded(mpl, ll)
+        synchron.handlePlaylist(state, src_idx, mpl, resp, seq, ll, segmentChan)
+        if mpl.Closed {
+            log.Errorln("Media Playlist closed ? This should not be happened!")
+            //close(segmentChan)
+            //return
+            synchron.sources.polled(src_idx, changed, blocking, nil, 0)
+            synchron.sources.playlistFailed(src_idx)
+        } else {
+            delay := timer.reloadDelay(mpl, ll, resp, changed)
+            synchron.sources.polled(src_idx, changed, blocking, nil, delay)
+            synchron.pause(delay)
+        }
+    }
+}
+
+// lowLatency tells if partial segments of ll are republished in synced playlist. Parts are synced as they are on
+// source, so it is not possible when segments are re-encrypted or taken from redundant sources.
+func (synchron *Synchronizer) lowLatency(ll *lowLatency) bool {
+    return synchron.option.Sync.Enabled && synchron.option.Sync.LowLatency && nil != ll && ll.partTarget > 0 &&
+        nil == synchron.encryptor && nil == synchron.alternates && !synchron.option.Sync.ReSegment
+}
+
+// loadPlaylist loads the media playlist of a source. When the source is a master playlist, the selected variant
+// is kept in variants and followed until it is re-resolved after master refresh interval. Low-Latency HLS tags of
+// the playlist are returned with its numbering of segments, ll of the previous load makes it a blocking reload when
+// supported by source. Requests are bound to ctx.
+func (synchron *Synchronizer) loadPlaylist(ctx context.Context, srcUrl string, variants map[string]*resolvedVariant, ll *lowLatency) (*m3u8.MediaPlaylist, *http.Response, *lowLatency, sourceSequence, error) {
+    var seq sourceSequence
+    master_refresh := time.Duration(synchron.option.Source.MasterRefresh) * time.Second
+    // A master playlist takes one more request to its selected variant.
+    for i := 0; i < 2; i++ {
+        urlStr := srcUrl
+        if rv, ok := variants[srcUrl]; ok {
+            if master_refresh > 0 && time.Now().Sub(rv.resolved) >= master_refresh {
+                log.Debugf("Re-resolving master playlist:> %s \n", srcUrl)
+            } else {
+                urlStr = rv.url
             }
         }
-        urlStr := synchron.option.Source.Urls[src_idx]
-        req, err := http.NewRequest("GET", urlStr, nil)
+        reqUrl, blocking := ll.blockingURL(urlStr)
+        req, err := http.NewRequest("GET", reqUrl, nil)
         if err != nil {
-            log.Errorln("Create Request failed:>", err)
-            continue
+            return nil, nil, nil, seq, err
+        }
+        req = req.WithContext(ctx)
+        var resp *http.Response
+        if blocking {
+            resp, err = synchron.doRequestTimeout(req, holdTime(ll.targetDuration))
+        } else {
+            resp, err = synchron.doRequest(req)
         }
-        resp, err := synchron.doRequest(req)
         if err != nil {
-            log.Errorln("doRequest failed:> ", retry, err)
-            time.Sleep(time.Duration(1) * time.Second)
-            retry++
-            continue
+            delete(variants, srcUrl)
+            return nil, nil, nil, seq, err
+        }
+        if resp.StatusCode != 200 {
+            resp.Body.Close()
+            delete(variants, srcUrl)
+            return nil, nil, nil, seq, &httpStatusError{code: resp.StatusCode, what: "playlist"}
         }
         respBody, err := ioutil.ReadAll(resp.Body)
+        resp.Body.Close()
         if err != nil {
-            log.Errorln("Read Playlist Response body failed:> ", retry, err)
-            time.Sleep(time.Duration(1) * time.Second)
-            retry++
-            continue
+            delete(variants, srcUrl)
+            return nil, nil, nil, seq, fmt.Errorf("read playlist response body: %s", err)
         }
+        seq.media = bytes.Contains(respBody, []byte("#EXT-X-MEDIA-SEQUENCE:"))
+        seq.declared = bytes.Contains(respBody, []byte(discontinuitySequenceTag))
+        respBody, seq.discontinuity = stripDiscontinuitySequence(respBody)
         buffer := bytes.NewBuffer(respBody)
         playlist, listType, err := m3u8.Decode(*buffer, true, synchron.option.ProgramTimeFormat, synchron.program_timezone)
         if err != nil {
-            log.Errorln("Decode playlist failed:> ", retry, err)
-            time.Sleep(time.Duration(1) * time.Second)
-            retry++
-            continue
+            delete(variants, srcUrl)
+            return nil, nil, nil, seq, fmt.Errorf("decode playlist: %s", err)
         }
-        resp.Body.Close()
-        mpl_updated := false
-        lastTimestamp := time.Now()
-        seg_num := 0
-        if listType == m3u8.MEDIA {
+        switch listType {
+        case m3u8.MEDIA:
             mpl := playlist.(*m3u8.MediaPlaylist)
-            //mpl.SetWinSize()
-            retry = 0
-            for _, v := range mpl.Segments {
-                if v != nil {
-                    //log.Debugln("Segment:> ", v.URI, v.ProgramDateTime)
-                    seg_num++
-                    t, hit := cache.Get(v.URI)
-                    if !hit {
-                        if timestamp_type == TST_SEGMENT {
-                            v.ProgramDateTime, _ = timefmt.Strptime(v.URI, synchron.option.TimestampFormat, synchron.option.ProgramTimezone)
-                        }
-                        if timestamp_type == TST_LOCAL || v.ProgramDateTime.Year() < 2016 || v.ProgramDateTime.Month() == 0 || v.ProgramDateTime.Day() == 0 {
-                            v.ProgramDateTime = lastTimestamp
-                            lastTimestamp = lastTimestamp.Add(time.Duration(v.Duration*1000) * time.Millisecond)
-                        } else {
-                            v.ProgramDateTime = v.ProgramDateTime.Add(timezone_shift)
-                        }
-                        cache.Add(v.URI, v.ProgramDateTime)
-                        last_new_segment = time.Now()
-                        log.Infof("New segment:> %d | %s | %f | %s \n", mpl.SeqNo, v.URI, v.Duration, v.ProgramDateTime)
-                        if synchron.option.Sync.Enabled || synchron.option.Record.Enabled {
-                            // Only get segments when sync or record enabled.
-                            msg := &SegmentMessage{}
-                            msg._type = SEGMEMT
-                            msg._hit = false
-                            msg._target_duration = mpl.TargetDuration
-                            msg.segment = v
-                            msg.response = resp
-                            segmentChan <- msg
-                        }
-                        mpl_updated = true
-                    } else {
-                        v.ProgramDateTime = t.(time.Time)
-                        lastTimestamp = v.ProgramDateTime.Add(time.Duration(v.Duration) * time.Second)
-                        if synchron.option.Sync.Enabled || synchron.option.Record.Enabled {
-                            // Only get segments when sync or record enabled.
-                            msg := &SegmentMessage{}
-                            msg._type = SEGMEMT
-                            msg._hit = true
-                            msg._target_duration = mpl.TargetDuration
-                            msg.segment = v
-                            msg.response = resp
-                            segmentChan <- msg
-                        }
+            loaded := parseLowLatency(respBody, mpl.SeqNo, resp.Request.URL)
+            if nil != loaded {
+                loaded.url = urlStr
+                loaded.targetDuration = mpl.TargetDuration
+            }
+            return mpl, resp, loaded, seq, nil
+        case m3u8.MASTER:
+            variant, err := selectVariant(playlist.(*m3u8.MasterPlaylist), &synchron.option.Source)
+            if err != nil {
+                return nil, nil, nil, seq, fmt.Errorf("select variant from master playlist: %s", err)
+            }
+            variantUrl, err := resp.Request.URL.Parse(variant.URI)
+            if err != nil {
+                return nil, nil, nil, seq, fmt.Errorf("parse variant URL: %s", err)
+            }
+            variantStr := synchron.withTokens(resp.Request.URL, variantUrl.String())
+            if rv, ok := variants[srcUrl]; !ok || rv.url != variantStr {
+                log.Infof("Selected variant:> %s | BANDWIDTH=%d | RESOLUTION=%s | CODECS=%s \n", variantUrl, variant.Bandwidth, variant.Resolution, variant.Codecs)
+            }
+            variants[srcUrl] = &resolvedVariant{url: variantStr, resolved: time.Now(), params: variant.VariantParams}
+        default:
+            delete(variants, srcUrl)
+            return nil, nil, nil, seq, errors.New("not a valid media playlist")
+        }
+    }
+    return nil, nil, nil, seq, errors.New("variant of master playlist is not a media playlist")
+}
+
+// handlePlaylist timestamps segments of a media playlist loaded from source src_idx and queues them for downloading.
+// Segments are told apart by numbering of source seq. Partial segments of ll are queued as well when republishing
+// Low-Latency HLS.
+func (synchron *Synchronizer) handlePlaylist(state *playlistState, src_idx int, mpl *m3u8.MediaPlaylist, resp *http.Response, seq sourceSequence, ll *lowLatency, segmentChan chan *SegmentMessage) {
+    mpl_updated := false
+    lastTimestamp := time.Now()
+    seg_num := 0
+    // EXT-X-KEY applies to all following segments until the next one.
+    var crypt_key *m3u8.Key
+    // EXT-X-MAP applies the same way.
+    var init_map *m3u8.Map
+    // Switching to another source or variant breaks continuity, redundant sources are aligned instead. Queries like
+    // blocking reload and signatures are not part of the origin, neither are hosts unless segments are told apart by URI.
+    origin := fmt.Sprintf("%d|%s%s", src_idx, resp.Request.URL.Host, resp.Request.URL.Path)
+    if synchron.dedupBy != DB_URI {
+        origin = fmt.Sprintf("%d|%s", src_idx, resp.Request.URL.Path)
+    }
+    switched := synchron.alternates == nil && state.origin != "" && state.origin != origin
+    // A reset of media sequence breaks continuity too.
+    if synchron.checkSequence(state, mpl, seq) {
+        switched = true
+    }
+    // Segments backfilled of a gap are prepended.
+    mpl, gap := synchron.checkGap(state, mpl, resp, seq, switched)
+    var discontinuity_seq uint64
+    rangeOffsets(mpl)
+    //mpl.SetWinSize()
+    for _, v := range mpl.Segments {
+        if v != nil {
+            //log.Debugln("Segment:> ", v.URI, v.ProgramDateTime)
+            v.SeqId = mpl.SeqNo + uint64(seg_num)
+            seg_num++
+            if v.Key != nil {
+                crypt_key = v.Key
+            }
+            crypt, e := segmentEncryption(crypt_key, v, resp)
+            if nil != e {
+                log.Errorf("Get encryption of segment '%s' failed:> %s \n", v.URI, e)
+            }
+            if v.Map != nil {
+                init_map = v.Map
+            }
+            // Synced playlist refers to initialization sections written locally.
+            v.Map = nil
+            var section *initSection
+            if init_map != nil {
+                if u, e := resp.Request.URL.Parse(init_map.URI); nil != e {
+                    log.Errorf("Parse initialization section URI '%s' failed:> %s \n", init_map.URI, e)
+                } else {
+                    section = &initSection{uri: synchron.withTokens(resp.Request.URL, u.String()), limit: init_map.Limit, offset: init_map.Offset, crypt: crypt}
+                }
+            }
+            if v.Key != nil && crypt != nil {
+                // Synced playlist refers to keys of source when segments are kept encrypted, otherwise drop the keys.
+                if synchron.option.Sync.KeepEncrypted || crypt.method != METHOD_AES128 {
+                    v.Key.URI = crypt.uri
+                } else {
+                    v.Key = nil
+                }
+            }
+            if crypt != nil {
+                crypt.uri = synchron.withTokens(resp.Request.URL, crypt.uri)
+            }
+            if v.Discontinuity {
+                seq.discontinuity++
+            }
+            key := synchron.segmentKey(v, resp.Request.URL, seq)
+            if synchron.alternates != nil {
+                if u, e := resp.Request.URL.Parse(v.URI); nil == e {
+                    synchron.alternates.add(key, src_idx, synchron.withTokens(resp.Request.URL, u.String()), v.Limit, v.Offset, crypt)
+                }
+            }
+            t, hit := state.cache.Get(key)
+            var sequence uint64
+            if !hit {
+                if state.timestamp_type == TST_SEGMENT {
+                    v.ProgramDateTime, _ = timefmt.Strptime(v.URI, synchron.option.TimestampFormat, synchron.option.ProgramTimezone)
+                }
+                if state.timestamp_type == TST_LOCAL || v.ProgramDateTime.Year() < 2016 || v.ProgramDateTime.Month() == 0 || v.ProgramDateTime.Day() == 0 {
+                    v.ProgramDateTime = lastTimestamp
+                    if synchron.clock != nil {
+                        // Align timestamps with other renditions of the ladder by media sequence, for lack of PROGRAM-DATE-TIME.
+                        v.ProgramDateTime = synchron.clock.align(v.SeqId, v.ProgramDateTime, mpl.TargetDuration, synchron.variant)
                     }
+                    lastTimestamp = v.ProgramDateTime.Add(time.Duration(v.Duration*1000) * time.Millisecond)
+                } else {
+                    v.ProgramDateTime = v.ProgramDateTime.Add(state.timezone_shift)
+                }
+                if switched {
+                    v.Discontinuity = true
+                    switched = false
+                }
+                if v.Discontinuity {
+                    state.discontinuity++
                 }
+                sequence = state.discontinuity
+                state.cache.Add(key, &knownSegment{timestamp: v.ProgramDateTime, discontinuity: v.Discontinuity, sequence: sequence})
+                state.origin = origin
+                state.last_new_segment = time.Now()
+                synchron.segmentArrived()
+                log.Infof("New segment:> %d | %s | %f | %s \n", mpl.SeqNo, v.URI, v.Duration, v.ProgramDateTime)
+                mpl_updated = true
+            } else {
+                known := t.(*knownSegment)
+                v.ProgramDateTime = known.timestamp
+                v.Discontinuity = known.discontinuity
+                sequence = known.sequence
+                lastTimestamp = v.ProgramDateTime.Add(time.Duration(v.Duration) * time.Second)
             }
-            if time.Now().Sub(last_new_segment) >= time.Duration(mpl.TargetDuration)*time.Second*time.Duration(seg_num) {
-                log.Warningf("Long time without new segment, please check stream continuity. [ %s -> %s ] \n", last_new_segment, time.Now())
+            if seg_num == 1 {
+                discontinuity_seq = state.discontinuity
+                if known, ok := t.(*knownSegment); ok {
+                    discontinuity_seq = known.sequence
+                }
+                if v.Discontinuity {
+                    discontinuity_seq--
+                }
             }
-            if synchron.option.Sync.Enabled && mpl_updated {
+            if synchron.option.Sync.Enabled || synchron.option.Record.Enabled {
+                // Only get segments when sync or record enabled.
                 msg := &SegmentMessage{}
-                msg._type = PLAYLIST
+                msg._type = SEGMEMT
+                msg._hit = hit
                 msg._target_duration = mpl.TargetDuration
-                msg.segment = nil
+                msg._source = src_idx
+                msg._key = key
+                msg._crypt = crypt
+                msg._map = section
+                msg._discontinuity = sequence
+                msg._behind = int(mpl.Count()) - seg_num
+                if nil != gap && seg_num <= gap.backfill && !hit {
+                    msg._gap = gap
+                    synchron.gapPending(gap)
+                }
+                msg.segment = v
                 msg.response = resp
-                msg.playlist = mpl
-                segmentChan <- msg
+                select {
+                case segmentChan <- msg:
+                case <-synchron.quit:
+                }
             }
-            if mpl.Closed {
-                log.Errorln("Media Playlist closed ? This should not be happened!")
-                //close(segmentChan)
-                //return
-                retry++
-            } else {
-                time.Sleep(time.Duration(int64((mpl.TargetDuration / 2) * 1000000000)))
+        }
+    }
+    if nil != gap {
+        synchron.gapQueued(gap)
+    }
+    // Keys are written before segments, the default key is not needed.
+    mpl.Key = nil
+    mpl.Map = nil
+    parts_updated := false
+    if synchron.lowLatency(ll) && (nil == crypt_key || crypt_key.Method == "NONE") {
+        for _, part := range ll.parts {
+            synchron.queuePart(state, src_idx, part, mpl, resp, segmentChan)
+            if !part.file.listed {
+                part.file.listed = true
+                parts_updated = true
             }
-        } else {
-            log.Errorln("> Not a valid media playlist.", retry)
-            retry++
         }
+    } else {
+        ll = nil
+    }
+    synchron.sources.playlistFetched(src_idx, mpl.SeqNo+uint64(seg_num), mpl.TargetDuration)
+    if time.Now().Sub(state.last_new_segment) >= time.Duration(mpl.TargetDuration)*time.Second*time.Duration(seg_num) {
+        log.Warningf("Long time without new segment, please check stream continuity. [ %s -> %s ] \n", state.last_new_segment, time.Now())
+    }
+    if synchron.option.Sync.Enabled && (mpl_updated || parts_updated) {
+        msg := &SegmentMessage{}
+        msg._type = PLAYLIST
+        msg._target_duration = mpl.TargetDuration
+        msg.segment = nil
+        msg.response = resp
+        msg.playlist = mpl
+        msg._discontinuity = discontinuity_seq
+        msg._parts = ll
+        select {
+        case segmentChan <- msg:
+        case <-synchron.quit:
+        }
+    }
+    if nil != ll && nil != ll.hint {
+        // The hint is fetched ahead after the playlist, source holds the request until the part is available.
+        synchron.queuePart(state, src_idx, ll.hint, mpl, resp, segmentChan)
+    }
+}
+
+// queuePart queues a partial segment for downloading unless it is known.
+func (synchron *Synchronizer) queuePart(state *playlistState, src_idx int, part *partialSegment, mpl *m3u8.MediaPlaylist, resp *http.Response, segmentChan chan *SegmentMessage) {
+    if f, ok := state.parts.Get(part.key()); ok {
+        part.file = f.(*partFile)
+        return
+    }
+    part.file = &partFile{name: synchron.partName(part)}
+    state.parts.Add(part.key(), part.file)
+    if part.gap {
+        return
+    }
+    msg := &SegmentMessage{}
+    msg._type = PART
+    msg._target_duration = mpl.TargetDuration
+    msg._source = src_idx
+    msg._part = part
+    msg.segment = partSegment(part)
+    msg.response = resp
+    select {
+    case segmentChan <- msg:
+    case <-synchron.quit:
     }
-    // Close segment message channel.
-    close(segmentChan)
 }
 
 func (synchron *Synchronizer) segmentProc(segmentChan chan *SegmentMessage, syncChan chan *SyncMessage, recordChan chan *RecordMessage) {
-    for msg := range segmentChan {
-        if nil == msg {
+    // Close following channels.
+    defer close(syncChan)
+    defer close(recordChan)
+    // Segments are downloaded in parallel but delivered in order of the queue.
+    jobs := make(chan *segmentJob, synchron.workers())
+    go synchron.guard("segmentDispatch", func() { synchron.dispatchSegments(segmentChan, jobs) })
+    var resegment *resegmenter
+    if synchron.option.Sync.ReSegment {
+        resegment = synchron.newResegmenter()
+    }
+    for job := range jobs {
+        select {
+        case <-job.done:
+        case <-synchron.quit:
             continue
         }
+        msg := job.msg
         if msg._type == PLAYLIST {
+            if nil != resegment {
+                // Segments cut are synced with a playlist of their own.
+                continue
+            }
+            if nil != synchron.encryptor {
+                synchron.applyKeys(msg.playlist)
+            }
+            synchron.applyMaps(msg.playlist)
             le_msg := &SyncMessage{}
             le_msg._type = msg._type
             le_msg.playlist = msg.playlist
+            le_msg.discontinuity = msg._discontinuity
+            le_msg.parts = msg._parts
+            le_msg.gaps = synchron.gapsOf(msg.playlist)
             le_msg.segment = nil
             le_msg.seg_buffer = nil
-            syncChan <- le_msg
+            select {
+            case syncChan <- le_msg:
+            case <-synchron.quit:
+            }
+            continue
+        } else if msg._type == PART {
+            if nil != job.err {
+                // Listed as a gap instead.
+                log.Errorf("Download partial segment '%s' failed:> %s \n", job.uri, job.err)
+                msg._part.file.gap = true
+                continue
+            }
+            le_msg := &SyncMessage{}
+            le_msg._type = PART
+            le_msg.segment = msg.segment
+            le_msg.seg_buffer = bytes.NewBuffer(job.data)
+            select {
+            case syncChan <- le_msg:
+            case <-synchron.quit:
+            }
+            continue
+        }
+        synchron.sources.segmentDownloaded(msg._source, nil == job.err)
+        if nil != msg._gap {
+            synchron.gapFilled(msg._gap, nil == job.err)
+        }
+        synchron.segmentResult(job.uri, job.err)
+        if nil != job.err {
+            log.Errorf("Download segment '%s' failed:> %s \n", job.uri, job.err)
+            synchron.gaps.Add(msg.segment.URI, true)
+            if nil != resegment {
+                // Segments cut so far end at the gap.
+                synchron.deliverCuts(resegment, resegment.interrupt(), syncChan, recordChan)
+            }
+            continue
+        }
+        if nil != resegment {
+            synchron.deliverCuts(resegment, resegment.add(job), syncChan, recordChan)
+        } else if !synchron.deliverSegment(job, syncChan, recordChan) {
+            // Listed as a gap instead, and downloaded again after restart.
+            synchron.gaps.Add(msg.segment.URI, true)
+            continue
+        }
+        // Known across restarts once delivered, segments failed are downloaded again after restart.
+        synchron.state.delivered(msg._key, msg.segment, msg._discontinuity)
+    }
+    if nil != resegment && !synchron.stopped() {
+        // Segments pending are cut at last.
+        synchron.deliverCuts(resegment, resegment.interrupt(), syncChan, recordChan)
+    }
+}
+
+// deliverSegment outputs a segment downloaded to sync and record, returns false if it failed.
+func (synchron *Synchronizer) deliverSegment(job *segmentJob, syncChan chan *SyncMessage, recordChan chan *RecordMessage) bool {
+    msg := job.msg
+    // Output segment, re-encrypted with local keys when encrypting enabled.
+    data := job.plain
+    var key *localKey
+    if nil != synchron.encryptor {
+        var e error
+        if data, key, e = synchron.encryptSegment(msg.segment, job.plain); nil != e {
+            log.Errorf("Encrypt segment '%s' failed:> %s \n", msg.segment.URI, e)
+            return false
+        }
+    }
+    // Initialization section is written before the first segment using it.
+    var init *localInit
+    if nil != msg._map {
+        init = synchron.updateInit(msg.segment, msg._map, job.init, key)
+    }
+    if synchron.option.Sync.Enabled {
+        le_msg := &SyncMessage{}
+        le_msg._type = SEGMEMT
+        le_msg.segment = msg.segment
+        if synchron.option.Sync.KeepEncrypted && nil == synchron.encryptor {
+            le_msg.seg_buffer = bytes.NewBuffer(job.data)
+            if nil != init {
+                le_msg.init_buffer = bytes.NewBuffer(init.data)
+            }
+        } else {
+            le_msg.seg_buffer = bytes.NewBuffer(data)
+            if nil != init {
+                le_msg.init_buffer = bytes.NewBuffer(init.plain)
+            }
+        }
+        select {
+        case syncChan <- le_msg:
+        case <-synchron.quit:
+        }
+    }
+    if synchron.option.Record.Enabled {
+        le_msg := &RecordMessage{}
+        le_msg._target_duration = msg._target_duration
+        le_msg.segment = msg.segment
+        le_msg.seg_buffer = bytes.NewBuffer(data)
+        le_msg.key = key
+        if nil != init {
+            le_msg.init_buffer = bytes.NewBuffer(init.plain)
+        }
+        select {
+        case recordChan <- le_msg:
+        case <-synchron.quit:
+        }
+    }
+    return true
+}
+
+// dispatchSegments starts downloading of new segments and queues them for in-order delivery.
+func (synchron *Synchronizer) dispatchSegments(segmentChan chan *SegmentMessage, jobs chan *segmentJob) {
+    defer close(jobs)
+    pacer := &catchUpPacer{interval: time.Duration(synchron.option.Download.CatchUp) * time.Second}
+    for msg := range segmentChan {
+        if nil == msg {
+            continue
+        }
+        job := &segmentJob{msg: msg, done: make(chan struct{})}
+        if msg._type == PLAYLIST {
+            close(job.done)
+        } else if msg._type == PART {
+            job.uri = synchron.withTokens(msg.response.Request.URL, msg._part.uri)
+            job.limit, job.offset = msg._part.limit, msg._part.offset
+            if !synchron.startDownload(job) {
+                return
+            }
         } else {
             var msURI string
             var msFilename string
+            // Segments named by timestamp keep the container of source.
+            ext := segmentExt(msg.segment.URI, nil != msg._map)
             if strings.HasPrefix(msg.segment.URI, "http://") || strings.HasPrefix(msg.segment.URI, "https://") {
                 //msURI, _ = url.QueryUnescape(msg.segment.URI)
-                msURI = msg.segment.URI
-                msFilename, _ = timefmt.Strftime(msg.segment.ProgramDateTime, synchron.sourceCrc16+"_%Y%m%d-%H%M%S.ts")
+                msURI = synchron.withTokens(msg.response.Request.URL, msg.segment.URI)
+                msFilename, _ = timefmt.Strftime(msg.segment.ProgramDateTime, synchron.sourceCrc16+"_%Y%m%d-%H%M%S"+ext)
             } else {
                 msUrl, _ := msg.response.Request.URL.Parse(msg.segment.URI)
                 //msURI, _ = url.QueryUnescape(msUrl.String())
-                msURI = msUrl.String()
-                if synchron.option.Sync.ReSegment {
-                    msFilename, _ = timefmt.Strftime(msg.segment.ProgramDateTime, synchron.sourceCrc16+"_%Y%m%d-%H%M%S.ts")
+                msURI = synchron.withTokens(msg.response.Request.URL, msUrl.String())
+                if synchron.option.Sync.ReSegment || synchron.alternates != nil {
+                    // Segments of redundant sources are named by timestamp, which is the same across sources.
+                    msFilename, _ = timefmt.Strftime(msg.segment.ProgramDateTime, synchron.sourceCrc16+"_%Y%m%d-%H%M%S"+ext)
+                } else if msg.segment.Limit > 0 {
+                    // Byte ranges of a resource are synced as individual segments.
+                    msFilename = rangeFilename(msg.segment.URI, msg.segment.Offset)
                 } else {
                     msFilename = msg.segment.URI
                 }
                 //msFilename,_ = timefmt.Strftime(msg.segment.ProgramDateTime, "%Y%m%d-%H%M%S.ts")
             }
             msg.segment.URI = msFilename
+            job.limit, job.offset = msg.segment.Limit, msg.segment.Offset
+            msg.segment.Limit, msg.segment.Offset = 0, 0
             if msg._hit {
                 continue
             }
-            log.Debugln("Downloading new segment:> ", msg.segment.URI)
-            for i := 0; i < synchron.option.Retries; i++ {
-                req, err := http.NewRequest("GET", msURI, nil)
-                if err != nil {
-                    log.Errorf("Create new request failed:> %s\n", err)
-                    continue
-                }
-                resp, err := synchron.doRequest(req)
-                if err != nil {
-                    log.Errorf("Do request failed:> %s \n", err)
-                    time.Sleep(time.Duration(1) * time.Second)
-                    continue
-                }
-                if resp.StatusCode != 200 {
-                    log.Errorf("Received HTTP %d for %s \n", resp.StatusCode, msURI)
-                    time.Sleep(time.Duration(1) * time.Second)
-                    continue
-                }
-                respBody, err := ioutil.ReadAll(resp.Body)
-                if err != nil {
-                    log.Errorln("Read Segment Response body failed:> ", err)
-                    time.Sleep(time.Duration(1) * time.Second)
-                    continue
-                }
-                resp.Body.Close()
-                buffer := bytes.NewBuffer(respBody)
-                bufdata := buffer.Bytes()
-                if synchron.option.Sync.Enabled {
-                    le_msg := &SyncMessage{}
-                    le_msg._type = SEGMEMT
-                    le_msg.segment = msg.segment
-                    le_msg.seg_buffer = bytes.NewBuffer(bufdata)
-                    syncChan <- le_msg
-                }
-                if synchron.option.Record.Enabled {
-                    le_msg := &RecordMessage{}
-                    le_msg._target_duration = msg._target_duration
-                    le_msg.segment = msg.segment
-                    le_msg.seg_buffer = bytes.NewBuffer(bufdata)
-                    recordChan <- le_msg
-                }
-                break // It's done, boy!!!
+            job.uri = msURI
+            if !synchron.startPaced(job, pacer.pace(msg._behind, msg._target_duration)) {
+                return
             }
         }
+        select {
+        case jobs <- job:
+        case <-synchron.quit:
+            return
+        }
     }
-    // Close following channels.
-    close(recordChan)
-    close(syncChan)
 }
 
 func (synchron *Synchronizer) doRequest(req *http.Request) (*http.Response, error) {
-    req.Header.Set("User-Agent", synchron.option.UserAgent)
-    resp, err := synchron.client.Do(req)
+    return synchron.doRequestTimeout(req, 0)
+}
+
+// doRequestTimeout does a request which may take extra time more than the request timeout, like blocking reloads.
+// Requests not bound to a context are bound to stop, so none outlives the synchronizer.
+func (synchron *Synchronizer) doRequestTimeout(req *http.Request, extra time.Duration) (*http.Response, error) {
+    if req.Context() == context.Background() {
+        req = req.WithContext(synchron.ctx)
+    }
+    req.Header.Set("User-Agent", synchron.userAgent())
+    synchron.authorize(req)
+    client := synchron.client
+    if extra > 0 && client.Timeout > 0 {
+        c := *client
+        c.Timeout += extra
+        client = &c
+    }
+    resp, err := client.Do(req)
     if nil != err {
         log.Errorf("doRequest:> Request %s failed: %s \n", req.URL.Path, err)
     }
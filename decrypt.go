@@ -0,0 +1,169 @@
+/**
+This source file contains the decryption of AES-128 encrypted segments.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+	"github.com/golang/groupcache/lru"
+)
+
+const (
+	METHOD_NONE       = "NONE"
+	METHOD_AES128     = "AES-128"
+	METHOD_SAMPLE_AES = "SAMPLE-AES"
+)
+
+// segmentCrypt is how a segment was encrypted by source.
+type segmentCrypt struct {
+	method string
+	uri    string // Absolute URL of the key.
+	iv     []byte
+}
+
+// keyCache keeps keys fetched from sources, keyed by absolute key URL. Rotated keys have different URLs.
+type keyCache struct {
+	sync.Mutex
+	cache    *lru.Cache
+	fetching map[string]*keyFetch
+}
+
+// keyFetch is a key being fetched, whose result is shared by all segments waiting for it.
+type keyFetch struct {
+	done chan struct{}
+	key  []byte
+	err  error
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{cache: lru.New(64), fetching: make(map[string]*keyFetch)}
+}
+
+// parseIV parses an explicit IV, or makes the implicit IV from media sequence number of the segment.
+func parseIV(iv string, seqId uint64) ([]byte, error) {
+	if iv == "" {
+		buf := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(buf[8:], seqId)
+		return buf, nil
+	}
+	s := strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")
+	if len(s) < 32 {
+		s = strings.Repeat("0", 32-len(s)) + s
+	}
+	buf, e := hex.DecodeString(s)
+	if nil != e || len(buf) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV '%s'", iv)
+	}
+	return buf, nil
+}
+
+// segmentEncryption returns how segment v is encrypted, where key is the last EXT-X-KEY before the segment.
+// It returns nil for clear segments.
+func segmentEncryption(key *m3u8.Key, v *m3u8.MediaSegment, resp *http.Response) (*segmentCrypt, error) {
+	if nil == key || key.Method == "" || strings.ToUpper(key.Method) == METHOD_NONE {
+		return nil, nil
+	}
+	keyUrl, e := resp.Request.URL.Parse(key.URI)
+	if nil != e {
+		return nil, fmt.Errorf("parse key URL '%s': %s", key.URI, e)
+	}
+	iv, e := parseIV(key.IV, v.SeqId)
+	if nil != e {
+		return nil, e
+	}
+	return &segmentCrypt{method: strings.ToUpper(key.Method), uri: keyUrl.String(), iv: iv}, nil
+}
+
+// fetchKey returns the key at uri, fetched from source when it is not cached yet. The key is fetched once for
+// downloads asking for it at the same time, without holding back downloads of other keys.
+func (synchron *Synchronizer) fetchKey(uri string) ([]byte, error) {
+	keys := synchron.keys
+	keys.Lock()
+	if v, ok := keys.cache.Get(uri); ok {
+		keys.Unlock()
+		return v.([]byte), nil
+	}
+	if fetch, ok := keys.fetching[uri]; ok {
+		keys.Unlock()
+		<-fetch.done
+		return fetch.key, fetch.err
+	}
+	fetch := &keyFetch{done: make(chan struct{})}
+	keys.fetching[uri] = fetch
+	keys.Unlock()
+	fetch.key, fetch.err = synchron.requestKey(uri)
+	keys.Lock()
+	delete(keys.fetching, uri)
+	if nil == fetch.err {
+		keys.cache.Add(uri, fetch.key)
+	}
+	keys.Unlock()
+	close(fetch.done)
+	return fetch.key, fetch.err
+}
+
+// requestKey fetches the key at uri from source.
+func (synchron *Synchronizer) requestKey(uri string) ([]byte, error) {
+	req, e := http.NewRequest("GET", uri, nil)
+	if nil != e {
+		return nil, e
+	}
+	req = req.WithContext(synchron.ctx)
+	resp, e := synchron.doRequest(req)
+	if nil != e {
+		return nil, e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &httpStatusError{code: resp.StatusCode, what: "key " + uri}
+	}
+	key, e := ioutil.ReadAll(resp.Body)
+	if nil != e {
+		return nil, e
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid key length %d of %s", len(key), uri)
+	}
+	log.Infof("Fetched key:> %s \n", uri)
+	return key, nil
+}
+
+// decryptSegment decrypts an AES-128 encrypted segment. Segments of other methods are returned as they are.
+func (synchron *Synchronizer) decryptSegment(crypt *segmentCrypt, data []byte) ([]byte, error) {
+	if crypt.method != METHOD_AES128 {
+		log.Warningf("Encryption method %s is not supported, segment is kept encrypted. \n", crypt.method)
+		return data, nil
+	}
+	key, e := synchron.fetchKey(crypt.uri)
+	if nil != e {
+		return nil, e
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted segment size %d is not multiple of block size", len(data))
+	}
+	block, e := aes.NewCipher(key)
+	if nil != e {
+		return nil, e
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, crypt.iv).CryptBlocks(plain, data)
+	// Remove PKCS7 padding.
+	n := int(plain[len(plain)-1])
+	if n < 1 || n > aes.BlockSize || !bytes.Equal(plain[len(plain)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errors.New("invalid padding, wrong key or IV")
+	}
+	return plain[:len(plain)-n], nil
+}
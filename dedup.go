@@ -0,0 +1,124 @@
+/**
+This source file contains the deduplication of segments across playlist updates, by media sequence or by URI.
+*/
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+	"github.com/golang/groupcache/lru"
+)
+
+type DedupBy uint8
+
+const (
+	DB_SEQUENCE DedupBy = 1 + iota
+	DB_PATH
+	DB_URI
+)
+
+func parseDedupBy(s string) (DedupBy, error) {
+	switch strings.ToLower(s) {
+	case "", "sequence":
+		return DB_SEQUENCE, nil
+	case "path":
+		return DB_PATH, nil
+	case "uri":
+		return DB_URI, nil
+	}
+	return 0, fmt.Errorf("unknown dedup by '%s'", s)
+}
+
+// sourceSequence is the numbering of segments in a media playlist of source.
+type sourceSequence struct {
+	media         bool   // EXT-X-MEDIA-SEQUENCE is present, otherwise media sequence numbers are not reliable.
+	declared      bool   // EXT-X-DISCONTINUITY-SEQUENCE is present.
+	discontinuity uint64 // EXT-X-DISCONTINUITY-SEQUENCE, and discontinuities counted after it.
+}
+
+// numbering returns the discontinuity sequence segments are numbered by. It is 0 for sources not declaring it, as
+// discontinuities counted drop when they slide out of playlist, segments are numbered by media sequence alone then.
+func (seq sourceSequence) numbering() uint64 {
+	if seq.declared {
+		return seq.discontinuity
+	}
+	return 0
+}
+
+// sequencePosition is the position of a segment in stream, by discontinuity sequence and then media sequence.
+type sequencePosition struct {
+	discontinuity uint64
+	media         uint64
+}
+
+func (p sequencePosition) before(o sequencePosition) bool {
+	return p.discontinuity < o.discontinuity || (p.discontinuity == o.discontinuity && p.media < o.media)
+}
+
+// dedupKey identifies a segment across playlist updates. The discontinuity sequence of seq is the one of segment v.
+// Keys by media sequence fall back to the path when the source does not number segments, paths are taken without
+// host and query, which may be rotated by origins.
+func (synchron *Synchronizer) dedupKey(v *m3u8.MediaSegment, base *url.URL, seq sourceSequence) string {
+	if synchron.dedupBy == DB_SEQUENCE && seq.media {
+		return fmt.Sprintf("seq:%d:%d", seq.numbering(), v.SeqId)
+	}
+	key := v.URI
+	if synchron.dedupBy != DB_URI {
+		if u, e := base.Parse(v.URI); nil == e {
+			key = u.Path
+		}
+	}
+	if v.Limit > 0 {
+		return fmt.Sprintf("%s@%d", key, v.Offset)
+	}
+	return key
+}
+
+// checkSequence detects a reset of media sequence, when a playlist ends before the previous one starts. Segments
+// known are forgotten then, as their keys are to be taken again by new segments.
+func (synchron *Synchronizer) checkSequence(state *playlistState, mpl *m3u8.MediaPlaylist, seq sourceSequence) bool {
+	if synchron.dedupBy != DB_SEQUENCE || !seq.media || nil != synchron.alternates {
+		return false
+	}
+	var first, last sequencePosition
+	n := uint64(0)
+	for _, v := range mpl.Segments {
+		if v != nil {
+			if v.Discontinuity {
+				seq.discontinuity++
+			}
+			last = sequencePosition{discontinuity: seq.numbering(), media: mpl.SeqNo + n}
+			if n == 0 {
+				first = last
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	reset := nil != state.position && last.before(*state.position)
+	if reset {
+		log.Warningf("Media sequence reset:> %d:%d -> %d:%d \n", state.position.discontinuity, state.position.media, first.discontinuity, first.media)
+		state.cache = lru.New(synchron.option.MaxSegments)
+	}
+	state.position = &first
+	return reset
+}
+
+// restorePosition takes the position of the last segment delivered before restart, so a reset or gap meanwhile is
+// detected.
+func (synchron *Synchronizer) restorePosition(state *playlistState, key string) {
+	if synchron.dedupBy != DB_SEQUENCE || nil != synchron.alternates {
+		return
+	}
+	var p sequencePosition
+	if n, _ := fmt.Sscanf(key, "seq:%d:%d", &p.discontinuity, &p.media); n == 2 {
+		state.position = &p
+		state.end = &streamEnd{position: p, numbered: true}
+	}
+}
@@ -0,0 +1,183 @@
+/**
+This source file contains the parallel segment downloading.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// segmentJob is a segment downloading in background, done is closed when finished.
+type segmentJob struct {
+	msg    *SegmentMessage
+	uri    string
+	limit  int64 // Length of byte range, 0 for the whole resource.
+	offset int64
+	done   chan struct{}
+	data   []byte // Segment as downloaded.
+	plain  []byte // Decrypted segment, the same as data for clear segments.
+	init   *fetchedInit
+	err    error
+}
+
+// Download slots per source host, shared by all channels in the process.
+var hostSlots = struct {
+	sync.Mutex
+	slots map[string]chan struct{}
+}{slots: make(map[string]chan struct{})}
+
+func hostSlot(host string, limit int) chan struct{} {
+	hostSlots.Lock()
+	defer hostSlots.Unlock()
+	slot, ok := hostSlots.slots[host]
+	if !ok {
+		if limit < 1 {
+			limit = 1
+		}
+		slot = make(chan struct{}, limit)
+		hostSlots.slots[host] = slot
+	}
+	return slot
+}
+
+func (synchron *Synchronizer) workers() int {
+	if synchron.option.Download.Workers < 1 {
+		return 1
+	}
+	return synchron.option.Download.Workers
+}
+
+// startDownload waits for free slots and downloads the segment of job in background.
+// It returns false when the synchronizer is stopped while waiting.
+func (synchron *Synchronizer) startDownload(job *segmentJob) bool {
+	select {
+	case synchron.downloadSlots <- struct{}{}:
+	case <-synchron.quit:
+		return false
+	}
+	var slot chan struct{}
+	if u, e := url.Parse(job.uri); nil == e {
+		slot = hostSlot(u.Host, synchron.option.Download.PerHost)
+		select {
+		case slot <- struct{}{}:
+		case <-synchron.quit:
+			<-synchron.downloadSlots
+			return false
+		}
+	}
+	go synchron.guard("segmentDownload", func() {
+		defer close(job.done)
+		defer func() {
+			if slot != nil {
+				<-slot
+			}
+			<-synchron.downloadSlots
+		}()
+		log.Debugln("Downloading new segment:> ", job.msg.segment.URI)
+		// Segments of invalid content are downloaded again, as responses of source may be truncated or
+		// replaced by error pages.
+		for i := 0; i < synchron.option.Retries; i++ {
+			if i > 0 {
+				log.Warningf("Downloading invalid segment again:> %s : %s \n", job.uri, job.err)
+			}
+			job.data, job.err = synchron.downloadSegment(job.uri, job.limit, job.offset)
+			if nil == job.err {
+				synchron.decodeSegment(job)
+			}
+			if _, invalid := job.err.(*invalidSegment); !invalid {
+				break
+			}
+		}
+		if nil != job.err && synchron.alternates != nil && job.msg._type == SEGMEMT && synchron.downloadAlternate(job) {
+			synchron.decodeSegment(job)
+		}
+		if nil == job.err && nil != job.msg._map {
+			job.init, job.err = synchron.fetchInit(job.msg._map)
+		}
+		if nil != job.err {
+			synchron.sourceDenied(job.msg._source, job.err)
+		}
+	})
+	return true
+}
+
+// decodeSegment decrypts and validates the segment downloaded.
+func (synchron *Synchronizer) decodeSegment(job *segmentJob) {
+	if nil != job.msg._crypt {
+		job.plain, job.err = synchron.decryptSegment(job.msg._crypt, job.data)
+	} else {
+		job.plain = job.data
+	}
+	if nil == job.err {
+		job.err = synchron.validateSegment(job)
+	}
+}
+
+// downloadSegment downloads a segment, or the byte range of it when limit is not 0.
+func (synchron *Synchronizer) downloadSegment(msURI string, limit int64, offset int64) (data []byte, err error) {
+	for i := 0; i < synchron.option.Retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(1) * time.Second)
+		}
+		var req *http.Request
+		if req, err = http.NewRequest("GET", msURI, nil); err != nil {
+			return nil, err
+		}
+		if limit > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+limit-1))
+		}
+		var resp *http.Response
+		if resp, err = synchron.doRequest(req); err != nil {
+			log.Errorf("Do request failed:> %s \n", err)
+			continue
+		}
+		if resp.StatusCode != 200 && (limit == 0 || resp.StatusCode != 206) {
+			resp.Body.Close()
+			err = &httpStatusError{code: resp.StatusCode}
+			log.Errorf("Received HTTP %d for %s \n", resp.StatusCode, msURI)
+			continue
+		}
+		data, err = ioutil.ReadAll(synchron.limitReader(resp.Body))
+		resp.Body.Close()
+		if err != nil {
+			log.Errorln("Read Segment Response body failed:> ", err)
+			continue
+		}
+		if resp.ContentLength >= 0 && int64(len(data)) != resp.ContentLength {
+			err = fmt.Errorf("received %d bytes of Content-Length %d", len(data), resp.ContentLength)
+			log.Errorf("Received %d bytes of Content-Length %d for %s \n", len(data), resp.ContentLength, msURI)
+			continue
+		}
+		if limit > 0 && resp.StatusCode == 200 {
+			// Server ignored the range and sent the whole resource.
+			if offset+limit > int64(len(data)) {
+				return nil, fmt.Errorf("byte range %d@%d exceeds size %d", limit, offset, len(data))
+			}
+			data = data[offset : offset+limit]
+		} else if limit > 0 && int64(len(data)) != limit {
+			err = fmt.Errorf("received %d bytes of byte range %d@%d", len(data), limit, offset)
+			log.Errorf("Received %d bytes of byte range %d@%d for %s \n", len(data), limit, offset, msURI)
+			continue
+		}
+		return data, nil
+	}
+	return nil, err
+}
+
+// rangeFilename names a byte range segment by its offset in the resource, eg: 'hour.ts' -> 'hour_1048576.ts'.
+func rangeFilename(uri string, offset int64) string {
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		uri = uri[:i]
+	}
+	ext := path.Ext(uri)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(uri, ext), offset, ext)
+}
@@ -0,0 +1,391 @@
+/**
+This source file contains the encryption of output segments with locally managed rotating keys.
+*/
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+	"github.com/archsh/go.timefmt"
+	"github.com/golang/groupcache/lru"
+)
+
+// localKey is a key generated for encrypting output segments.
+type localKey struct {
+	method string
+	name   string // Filename in key directory.
+	key    []byte
+	iv     []byte
+}
+
+// encryptor encrypts segments in order of delivery, the key is rotated every N segments.
+type encryptor struct {
+	method   string
+	dir      string
+	current  *localKey
+	used     int
+	segments *lru.Cache // Keys of encrypted segments by synced filename.
+}
+
+func parseEncryptMethod(s string) (string, error) {
+	switch strings.ToUpper(s) {
+	case "", METHOD_NONE:
+		return "", nil
+	case METHOD_AES128:
+		return METHOD_AES128, nil
+	case METHOD_SAMPLE_AES:
+		return METHOD_SAMPLE_AES, nil
+	}
+	return "", fmt.Errorf("unknown encrypt method '%s'", s)
+}
+
+// keyDir is where keys are stored, default 'keys' in record output, or sync output when recording is disabled.
+func (synchron *Synchronizer) keyDir() string {
+	if synchron.option.Encrypt.KeyDir != "" {
+		return synchron.option.Encrypt.KeyDir
+	}
+	if synchron.option.Record.Enabled {
+		return filepath.Join(synchron.option.Record.Output, "keys")
+	}
+	return filepath.Join(synchron.option.Sync.Output, "keys")
+}
+
+func (synchron *Synchronizer) newEncryptor(method string) *encryptor {
+	return &encryptor{method: method, dir: synchron.keyDir(), segments: lru.New(synchron.option.MaxSegments * 2)}
+}
+
+// nextKey generates a new key for segments starting at tm, and saves it into key directory.
+func (enc *encryptor) nextKey(prefix string, tm time.Time) (*localKey, error) {
+	key := &localKey{method: enc.method, key: make([]byte, aes.BlockSize), iv: make([]byte, aes.BlockSize)}
+	if _, e := rand.Read(key.key); nil != e {
+		return nil, e
+	}
+	if _, e := rand.Read(key.iv); nil != e {
+		return nil, e
+	}
+	if e := os.MkdirAll(enc.dir, 0777); nil != e {
+		return nil, e
+	}
+	name, e := timefmt.Strftime(tm, prefix+"_%Y%m%d-%H%M%S")
+	if nil != e {
+		return nil, e
+	}
+	key.name = name + ".key"
+	for i := 1; exists(filepath.Join(enc.dir, key.name)); i++ {
+		key.name = fmt.Sprintf("%s-%d.key", name, i)
+	}
+	if e := ioutil.WriteFile(filepath.Join(enc.dir, key.name), key.key, 0644); nil != e {
+		return nil, e
+	}
+	log.Infof("Generated key:> %s \n", filepath.Join(enc.dir, key.name))
+	return key, nil
+}
+
+// encryptSegment encrypts a segment with current key, which is rotated every N segments.
+// TS segments which can not be encrypted by SAMPLE-AES fall back to AES-128 with the same key.
+func (synchron *Synchronizer) encryptSegment(segment *m3u8.MediaSegment, data []byte) ([]byte, *localKey, error) {
+	enc := synchron.encryptor
+	if nil == enc.current || (synchron.option.Encrypt.RotateEvery > 0 && enc.used >= synchron.option.Encrypt.RotateEvery) {
+		key, e := enc.nextKey(synchron.sourceCrc16, segment.ProgramDateTime)
+		if nil != e {
+			synchron.writeResult("encrypt", enc.dir, e)
+			return nil, nil, e
+		}
+		synchron.writeResult("encrypt", filepath.Join(enc.dir, key.name), nil)
+		enc.current = key
+		enc.used = 0
+	}
+	enc.used++
+	key := enc.current
+	var out []byte
+	if key.method == METHOD_SAMPLE_AES {
+		var e error
+		if out, e = sampleAESEncrypt(key, data); nil != e {
+			log.Warningf("SAMPLE-AES encrypt segment '%s' failed, use AES-128 instead:> %s \n", segment.URI, e)
+			key = &localKey{method: METHOD_AES128, name: key.name, key: key.key, iv: key.iv}
+			out = nil
+		}
+	}
+	if nil == out {
+		out = aesEncrypt(key, data)
+	}
+	enc.segments.Add(segment.URI, key)
+	return out, key, nil
+}
+
+// playlistKey makes EXT-X-KEY of key for a playlist in folder base, the key URI is relative to base unless
+// a key URI prefix is given.
+func (synchron *Synchronizer) playlistKey(key *localKey, base string) *m3u8.Key {
+	if nil == key {
+		return nil
+	}
+	uri := key.name
+	if synchron.option.Encrypt.KeyUri != "" {
+		uri = strings.TrimSuffix(synchron.option.Encrypt.KeyUri, "/") + "/" + key.name
+	} else if rel, e := filepath.Rel(base, filepath.Join(synchron.encryptor.dir, key.name)); nil == e {
+		uri = filepath.ToSlash(rel)
+	}
+	return &m3u8.Key{Method: key.method, URI: uri, IV: "0x" + hex.EncodeToString(key.iv)}
+}
+
+// applyKeys sets keys of encrypted segments into the synced playlist.
+func (synchron *Synchronizer) applyKeys(mpl *m3u8.MediaPlaylist) {
+	for _, v := range mpl.Segments {
+		if nil == v {
+			continue
+		}
+		if key, ok := synchron.encryptor.segments.Get(v.URI); ok {
+			v.Key = synchron.playlistKey(key.(*localKey), synchron.option.Sync.Output)
+		} else {
+			v.Key = nil
+		}
+	}
+	mpl.Key = nil
+}
+
+// aesEncrypt encrypts the whole segment by AES-128-CBC with PKCS7 padding.
+func aesEncrypt(key *localKey, data []byte) []byte {
+	block, _ := aes.NewCipher(key.key)
+	n := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, len(data)+n)
+	copy(out, data)
+	for i := len(data); i < len(out); i++ {
+		out[i] = byte(n)
+	}
+	cipher.NewCBCEncrypter(block, key.iv).CryptBlocks(out, out)
+	return out
+}
+
+// sampleAESEncrypt encrypts H.264 and AAC samples of a TS segment as HLS SAMPLE-AES.
+func sampleAESEncrypt(key *localKey, data []byte) ([]byte, error) {
+	packets, e := splitTS(append([]byte(nil), data...))
+	if nil != e {
+		return nil, e
+	}
+	program, e := parseProgram(packets)
+	if nil != e {
+		return nil, e
+	}
+	pids := make(map[uint16]bool)
+	for pid, st := range program.streams {
+		if st == ST_H264 || st == ST_AAC_ADTS {
+			pids[pid] = true
+		} else if isMediaStream(st) {
+			return nil, fmt.Errorf("stream type 0x%02x is not supported", st)
+		}
+	}
+	if len(pids) == 0 {
+		return nil, errors.New("no H.264 or AAC stream")
+	}
+	block, e := aes.NewCipher(key.key)
+	if nil != e {
+		return nil, e
+	}
+	list := collectPES(packets, pids)
+	var config []byte
+	for _, pes := range list {
+		n, e := pes.header()
+		if nil != e {
+			return nil, e
+		}
+		var es []byte
+		if program.streams[pes.pid] == ST_H264 {
+			es = encryptH264(block, key.iv, pes.data[n:])
+		} else {
+			if nil == config {
+				config = adtsConfig(pes.data[n:])
+			}
+			es = encryptADTS(block, key.iv, pes.data[n:])
+		}
+		pes.data = append(pes.data[:n:n], es...)
+		if pes.data[4] != 0 || pes.data[5] != 0 {
+			// Bounded PES, update PES_packet_length.
+			length := len(pes.data) - 6
+			if length > 0xffff {
+				length = 0
+			}
+			pes.data[4], pes.data[5] = byte(length>>8), byte(length)
+		}
+	}
+	for _, p := range packets {
+		if tsPID(p) == program.pmtPid && tsPUSI(p) {
+			if e := encryptedPMT(p, config); nil != e {
+				return nil, e
+			}
+		}
+	}
+	return rebuildTS(packets, list), nil
+}
+
+// encryptedPMT changes stream types of encrypted streams in PMT and adds descriptors required by SAMPLE-AES.
+func encryptedPMT(p []byte, config []byte) error {
+	section, e := psiSection(p)
+	if nil != e {
+		return e
+	}
+	i := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+	out := append([]byte(nil), section[:i]...)
+	for i+5 <= len(section)-4 {
+		length := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		size := 5 + length
+		if i+size > len(section)-4 {
+			return errors.New("invalid PMT stream info")
+		}
+		entry := append([]byte(nil), section[i:i+size]...)
+		var desc []byte
+		switch entry[0] {
+		case ST_H264:
+			entry[0] = ST_H264_ENC
+			desc = []byte{0x0f, 4, 'z', 'a', 'v', 'c'}
+		case ST_AAC_ADTS:
+			entry[0] = ST_AAC_ADTS_ENC
+			desc = []byte{0x0f, 4, 'a', 'a', 'c', 'd'}
+			// Registration descriptor carrying audio setup information.
+			setup := append([]byte{'a', 'p', 'a', 'd', 'z', 'a', 'a', 'c', 0, 0, 1, byte(len(config))}, config...)
+			desc = append(desc, append([]byte{0x05, byte(len(setup))}, setup...)...)
+		}
+		if nil != desc {
+			length += len(desc)
+			entry = append(entry, desc...)
+			entry[3] = entry[3]&0xf0 | byte(length>>8)&0x0f
+			entry[4] = byte(length)
+		}
+		out = append(out, entry...)
+		i += size
+	}
+	return writeSection(p, out)
+}
+
+// encryptH264 encrypts NAL units of coded slices in an H.264 elementary stream. The first 32 bytes of a NAL unit
+// are clear, then one of every ten 16-byte blocks is encrypted, emulation prevention is applied after encrypting.
+func encryptH264(block cipher.Block, iv []byte, es []byte) []byte {
+	out := make([]byte, 0, len(es)+len(es)/64)
+	prev := 0
+	for start := 0; ; {
+		i := findStartCode(es, start)
+		if i < 0 {
+			break
+		}
+		begin := i + 3
+		end := findStartCode(es, begin)
+		if end < 0 {
+			end = len(es)
+		}
+		next := end
+		// Trailing zeros belong to the next start code.
+		for end > begin && es[end-1] == 0 {
+			end--
+		}
+		out = append(out, es[prev:begin]...)
+		nal := es[begin:end]
+		if len(nal) > 0 && (nal[0]&0x1f == 1 || nal[0]&0x1f == 5) {
+			if raw := unescapeNAL(nal); len(raw) > 48 {
+				mode := cipher.NewCBCEncrypter(block, iv)
+				for pos := 32; len(raw)-pos > 16; pos += 16 + 144 {
+					mode.CryptBlocks(raw[pos:pos+16], raw[pos:pos+16])
+				}
+				nal = escapeNAL(raw)
+			}
+		}
+		out = append(out, nal...)
+		prev = end
+		start = next
+	}
+	return append(out, es[prev:]...)
+}
+
+func findStartCode(es []byte, from int) int {
+	for i := from; i+2 < len(es); i++ {
+		if es[i] == 0 && es[i+1] == 0 && es[i+2] == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// unescapeNAL removes emulation prevention bytes.
+func unescapeNAL(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// escapeNAL inserts emulation prevention bytes.
+func escapeNAL(raw []byte) []byte {
+	out := make([]byte, 0, len(raw)+len(raw)/64)
+	zeros := 0
+	for _, b := range raw {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	if len(out) > 0 && out[len(out)-1] == 0 {
+		out = append(out, 3)
+	}
+	return out
+}
+
+// encryptADTS encrypts AAC frames of an ADTS stream. The ADTS header and following 16 bytes of a frame are clear,
+// then all whole 16-byte blocks are encrypted.
+func encryptADTS(block cipher.Block, iv []byte, es []byte) []byte {
+	out := append([]byte(nil), es...)
+	for pos := 0; pos+7 <= len(out) && out[pos] == 0xff && out[pos+1]&0xf0 == 0xf0; {
+		header := 7
+		if out[pos+1]&0x01 == 0 {
+			header = 9
+		}
+		length := int(out[pos+3]&0x03)<<11 | int(out[pos+4])<<3 | int(out[pos+5])>>5
+		if length < header || pos+length > len(out) {
+			break
+		}
+		if pos+header+16+16 <= pos+length {
+			body := out[pos+header+16 : pos+length]
+			n := len(body) / 16 * 16
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(body[:n], body[:n])
+		}
+		pos += length
+	}
+	return out
+}
+
+// adtsConfig makes AudioSpecificConfig from the first ADTS header.
+func adtsConfig(es []byte) []byte {
+	if len(es) < 7 || es[0] != 0xff || es[1]&0xf0 != 0xf0 {
+		return []byte{}
+	}
+	profile := es[2]>>6 + 1
+	frequency := (es[2] >> 2) & 0x0f
+	channels := (es[2]&0x01)<<2 | es[3]>>6
+	return []byte{profile<<3 | frequency>>1, (frequency&0x01)<<7 | channels<<3}
+}
@@ -0,0 +1,55 @@
+/**
+This source file contains the events emitted by synchronizers.
+*/
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	EVENT_FAILOVER = "failover"
+	EVENT_FAILBACK = "failback"
+	EVENT_GAP      = "gap"
+	EVENT_STALL    = "stall"
+	EVENT_DOWNLOAD = "download_failures"
+	EVENT_WRITE    = "write_failure"
+	EVENT_RECOVERY = "recovery"
+)
+
+type Event struct {
+	Type    string
+	Channel string
+	Message string
+	Time    time.Time
+	Fields  map[string]interface{}
+}
+
+type EventHandler func(event *Event)
+
+// OnEvent registers a handler called on every event emitted by the synchronizer.
+func (synchron *Synchronizer) OnEvent(handler EventHandler) {
+	synchron.eventLock.Lock()
+	defer synchron.eventLock.Unlock()
+	synchron.eventHandlers = append(synchron.eventHandlers, handler)
+}
+
+func (synchron *Synchronizer) emit(typ string, fields map[string]interface{}, format string, args ...interface{}) {
+	event := &Event{
+		Type:    typ,
+		Channel: synchron.name,
+		Message: fmt.Sprintf(format, args...),
+		Time:    time.Now(),
+		Fields:  fields,
+	}
+	log.Warningf("Event [%s] %s:> %s \n", event.Type, event.Channel, event.Message)
+	synchron.eventLock.Lock()
+	handlers := synchron.eventHandlers
+	synchron.eventLock.Unlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
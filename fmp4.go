@@ -0,0 +1,156 @@
+/**
+This source file contains the handling of fMP4/CMAF segments and their initialization sections (EXT-X-MAP).
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+	"github.com/archsh/go.timefmt"
+	"github.com/golang/groupcache/lru"
+)
+
+// initSection is the initialization section declared by EXT-X-MAP on source.
+type initSection struct {
+	uri    string // Absolute URL.
+	limit  int64
+	offset int64
+	crypt  *segmentCrypt // Encryption of the section, nil if clear.
+}
+
+func (section *initSection) id() string {
+	return fmt.Sprintf("%s@%d:%d", section.uri, section.limit, section.offset)
+}
+
+// fetchedInit is an initialization section as downloaded and decrypted.
+type fetchedInit struct {
+	data  []byte
+	plain []byte
+}
+
+// localInit is the initialization section written along with synced and recorded segments.
+type localInit struct {
+	id    string // Section on source and local key it is encrypted with.
+	name  string
+	data  []byte // As downloaded, for segments kept encrypted.
+	plain []byte // Decrypted, or encrypted with local key.
+}
+
+// initSet keeps initialization sections fetched from sources, and the local ones of delivered segments.
+type initSet struct {
+	sync.Mutex
+	cache *lru.Cache // Guarded by mutex, fetched in parallel downloads.
+	// Following are used in order of delivery only.
+	current  *localInit
+	segments *lru.Cache // Maps of synced segments, keyed by URI.
+}
+
+func newInitSet(maxSegments int) *initSet {
+	return &initSet{cache: lru.New(16), segments: lru.New(maxSegments * 2)}
+}
+
+// segmentExt returns the container extension of a segment, fMP4 is assumed for segments without one when
+// the playlist has EXT-X-MAP.
+func segmentExt(uri string, fmp4 bool) string {
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		uri = uri[:i]
+	}
+	if ext := path.Ext(uri); ext != "" && !strings.Contains(ext, "/") {
+		return ext
+	}
+	if fmp4 {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+// fetchInit returns the initialization section, fetched from source when it is not cached yet.
+func (synchron *Synchronizer) fetchInit(section *initSection) (*fetchedInit, error) {
+	synchron.inits.Lock()
+	defer synchron.inits.Unlock()
+	if v, ok := synchron.inits.cache.Get(section.id()); ok {
+		return v.(*fetchedInit), nil
+	}
+	data, e := synchron.downloadSegment(section.uri, section.limit, section.offset)
+	if nil != e {
+		return nil, e
+	}
+	fetched := &fetchedInit{data: data, plain: data}
+	if nil != section.crypt {
+		if fetched.plain, e = synchron.decryptSegment(section.crypt, data); nil != e {
+			return nil, e
+		}
+	}
+	log.Infof("Fetched initialization section:> %s \n", section.uri)
+	synchron.inits.cache.Add(section.id(), fetched)
+	return fetched, nil
+}
+
+// updateInit sets the local initialization section of a segment, which is encrypted with the key of the segment.
+// The section is returned when it changed and needs writing, otherwise nil.
+func (synchron *Synchronizer) updateInit(segment *m3u8.MediaSegment, section *initSection, fetched *fetchedInit, key *localKey) *localInit {
+	id := section.id()
+	if nil != key {
+		id += "|" + key.name
+	}
+	var changed *localInit
+	if current := synchron.inits.current; nil == current || current.id != id {
+		name, _ := timefmt.Strftime(segment.ProgramDateTime, synchron.sourceCrc16+"_%Y%m%d-%H%M%S-init"+segmentExt(section.uri, true))
+		changed = &localInit{id: id, name: name, data: fetched.data, plain: fetched.plain}
+		if nil != key {
+			// Initialization section follows EXT-X-KEY of the segment, the same key applies.
+			changed.plain = aesEncrypt(key, fetched.plain)
+		}
+		synchron.inits.current = changed
+	}
+	segment.Map = &m3u8.Map{URI: synchron.inits.current.name}
+	synchron.inits.segments.Add(segment.URI, segment.Map)
+	return changed
+}
+
+// applyMaps sets initialization sections of synced segments into the synced playlist.
+func (synchron *Synchronizer) applyMaps(mpl *m3u8.MediaPlaylist) {
+	for _, v := range mpl.Segments {
+		if nil == v {
+			continue
+		}
+		if m, ok := synchron.inits.segments.Get(v.URI); ok {
+			v.Map = m.(*m3u8.Map)
+		}
+	}
+}
+
+// writeInit writes an initialization section into dir unless it exists, returns its filename.
+func writeInit(dir string, name string, data []byte) (string, error) {
+	fname := filepath.Join(dir, name)
+	if exists(fname) {
+		return fname, nil
+	}
+	if e := os.MkdirAll(dir, 0777); nil != e {
+		return "", e
+	}
+	if e := ioutil.WriteFile(fname, data, 0666); nil != e {
+		return "", e
+	}
+	log.Infof("Wrote initialization section:> %s \n", fname)
+	return fname, nil
+}
+
+// playlistMap makes EXT-X-MAP of a recorded initialization section for a playlist in folder base.
+func playlistMap(fname string, base string) *m3u8.Map {
+	if fname == "" {
+		return nil
+	}
+	if rel, e := filepath.Rel(base, fname); nil == e {
+		fname = rel
+	}
+	return &m3u8.Map{URI: filepath.ToSlash(fname)}
+}
@@ -0,0 +1,470 @@
+/**
+This source file contains the detection of gaps between playlist updates, by media sequence or PROGRAM-DATE-TIME,
+the backfill of segments missing and the gap log.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+)
+
+// backfillTimeout bounds loading backup playlists for backfilling, which polling of the active source waits for.
+const backfillTimeout = 2 * time.Second
+
+const (
+	GAP_SEQUENCE = "sequence"
+	GAP_PROGRAM  = "program"
+)
+
+// streamEnd is the last segment of the previous playlist, as numbered and timestamped by source.
+type streamEnd struct {
+	position  sequencePosition
+	numbered  bool      // Position is by media sequence of source.
+	timestamp time.Time // PROGRAM-DATE-TIME of source, zero if unknown.
+	duration  float64
+}
+
+// GapEntry is a gap written to the gap log, when the segments backfilled of it are downloaded or failed.
+type GapEntry struct {
+	Channel    string    `json:"channel,omitempty"`
+	Detected   time.Time `json:"detected"`
+	Reason     string    `json:"reason"`         // sequence/program
+	From       uint64    `json:"from,omitempty"` // Media sequence of the first segment missing.
+	To         uint64    `json:"to,omitempty"`   // Media sequence of the last segment missing.
+	Start      time.Time `json:"start"`          // Timestamps of the hole by source, zero if unknown.
+	End        time.Time `json:"end"`
+	Missing    int       `json:"missing"`    // Segments missing, 0 if unknown.
+	Backfilled int       `json:"backfilled"` // Segments backfilled and downloaded.
+	Failed     int       `json:"failed"`     // Segments backfilled but failed to download.
+	backfill   int       // Segments backfilled, prepended to playlist.
+	pending    int       // Segments backfilled not downloaded yet.
+	queued     bool
+}
+
+// gapLog appends gaps to a JSON lines file, gaps are only emitted as events without filename.
+type gapLog struct {
+	sync.Mutex
+	filename string
+}
+
+// setupGapLog opens the gap log in the output directory, the same as the state file.
+func (synchron *Synchronizer) setupGapLog() {
+	synchron.gapLog = &gapLog{}
+	if dir := synchron.outputDir(); dir != "" && synchron.option.GapLog != "" {
+		synchron.gapLog.filename = filepath.Join(dir, synchron.option.GapLog)
+	}
+}
+
+// checkGap detects a gap between the previous playlist and mpl, and returns mpl with segments backfilled prepended.
+// Gaps by media sequence are only detected within the same discontinuity sequence, and not after switching sources
+// or a reset, where PROGRAM-DATE-TIME is compared only. Redundant sources fill gaps of each other instead.
+func (synchron *Synchronizer) checkGap(state *playlistState, mpl *m3u8.MediaPlaylist, resp *http.Response, seq sourceSequence, switched bool) (*m3u8.MediaPlaylist, *GapEntry) {
+	if nil != synchron.alternates {
+		return mpl, nil
+	}
+	segments := decodedSegments(mpl)
+	if len(segments) < 1 {
+		return mpl, nil
+	}
+	first, last := segments[0], segments[len(segments)-1]
+	end := &streamEnd{numbered: seq.media, duration: last.Duration}
+	counted := seq
+	for i, v := range segments {
+		v.SeqId = mpl.SeqNo + uint64(i)
+		if v.Discontinuity {
+			counted.discontinuity++
+		}
+	}
+	end.position = sequencePosition{discontinuity: counted.numbering(), media: mpl.SeqNo + uint64(len(segments)-1)}
+	if last.ProgramDateTime.Year() >= 2016 {
+		end.timestamp = last.ProgramDateTime
+	}
+	prev := state.end
+	state.end = end
+	if nil == prev {
+		return mpl, nil
+	}
+	var gap *GapEntry
+	var backfill []*m3u8.MediaSegment
+	if !switched && prev.numbered && seq.media && prev.position.discontinuity == seq.numbering() && mpl.SeqNo > prev.position.media+1 {
+		gap = &GapEntry{Reason: GAP_SEQUENCE, From: prev.position.media + 1, To: mpl.SeqNo - 1}
+		gap.Missing = int(gap.To - gap.From + 1)
+		backfill = synchron.backfillSequence(segments, resp, gap, seq.numbering())
+	} else if !prev.timestamp.IsZero() && first.ProgramDateTime.Year() >= 2016 &&
+		isGap(&m3u8.MediaSegment{ProgramDateTime: prev.timestamp, Duration: prev.duration}, first.ProgramDateTime) &&
+		first.ProgramDateTime.After(prev.timestamp) {
+		gap = &GapEntry{Reason: GAP_PROGRAM}
+		backfill = synchron.backfillProgram(prev, first, mpl.SeqNo)
+	} else {
+		return mpl, nil
+	}
+	gap.Channel = synchron.name
+	gap.Detected = time.Now()
+	if !prev.timestamp.IsZero() {
+		gap.Start = prev.timestamp.Add(time.Duration(prev.duration*1000) * time.Millisecond)
+	}
+	if first.ProgramDateTime.Year() >= 2016 {
+		gap.End = first.ProgramDateTime
+	}
+	if len(backfill) < 1 {
+		return mpl, gap
+	}
+	log.Infof("Backfilling %d segments of gap:> %d - %d \n", len(backfill), mpl.SeqNo-uint64(len(backfill)), mpl.SeqNo-1)
+	size := uint(len(backfill) + len(segments))
+	filled, e := m3u8.NewMediaPlaylist(size, size)
+	if nil != e {
+		log.Errorf("Create playlist for backfilling failed:> %s \n", e)
+		return mpl, gap
+	}
+	filled.SeqNo = mpl.SeqNo - uint64(len(backfill))
+	filled.TargetDuration = mpl.TargetDuration
+	filled.Closed = mpl.Closed
+	filled.MediaType = mpl.MediaType
+	filled.Key = mpl.Key
+	filled.Map = mpl.Map
+	filled.ProgramTimeFormat = mpl.ProgramTimeFormat
+	filled.ProgramTimeLocation = mpl.ProgramTimeLocation
+	for _, v := range append(backfill, segments...) {
+		filled.AppendSegment(v)
+	}
+	gap.backfill = len(backfill)
+	return filled, gap
+}
+
+// backfillSequence returns the segments missing by media sequence, the latest ones up to Download.Backfill which are
+// listed by other sources or whose URIs are derived from numbering of segments. Keys and initialization sections
+// applying to the first segment of playlist apply to them as well, sources are supposed to share them.
+func (synchron *Synchronizer) backfillSequence(segments []*m3u8.MediaSegment, resp *http.Response, gap *GapEntry, discontinuity uint64) []*m3u8.MediaSegment {
+	if synchron.option.Download.Backfill < 1 {
+		return nil
+	}
+	listed := synchron.backupSegments(func(v *m3u8.MediaSegment, seq sourceSequence) bool {
+		return seq.media && seq.numbering() == discontinuity && v.SeqId >= gap.From && v.SeqId <= gap.To
+	})
+	first := segments[0]
+	var backfill []*m3u8.MediaSegment
+	for n := gap.To; n >= gap.From && len(backfill) < synchron.option.Download.Backfill; n-- {
+		v, ok := listed[n]
+		if !ok && len(segments) > 1 {
+			if uri := guessURI(first, segments[1], n); uri != "" {
+				v = &m3u8.MediaSegment{SeqId: n, URI: uri, Duration: first.Duration}
+				if u, e := resp.Request.URL.Parse(uri); nil == e {
+					v.URI = u.String()
+				}
+				ok = true
+			}
+		}
+		if !ok {
+			break
+		}
+		backfill = append([]*m3u8.MediaSegment{v}, backfill...)
+	}
+	// Timestamps of segments derived continue backward from the first segment of playlist.
+	next := first
+	for i := len(backfill) - 1; i >= 0; i-- {
+		v := backfill[i]
+		if v.ProgramDateTime.Year() < 2016 && next.ProgramDateTime.Year() >= 2016 {
+			v.ProgramDateTime = next.ProgramDateTime.Add(-time.Duration(v.Duration*1000) * time.Millisecond)
+		}
+		next = v
+	}
+	if len(backfill) > 0 && nil == backfill[0].Key && nil != first.Key {
+		// Keys of segments are modified when they are queued.
+		key := *first.Key
+		backfill[0].Key = &key
+	}
+	if len(backfill) > 0 && nil == backfill[0].Map {
+		backfill[0].Map = first.Map
+	}
+	return backfill
+}
+
+// backfillProgram returns the segments missing by PROGRAM-DATE-TIME between prev and first, which are listed by other
+// sources. They are numbered before first, so not more than seqNo.
+func (synchron *Synchronizer) backfillProgram(prev *streamEnd, first *m3u8.MediaSegment, seqNo uint64) []*m3u8.MediaSegment {
+	if synchron.option.Download.Backfill < 1 {
+		return nil
+	}
+	start := prev.timestamp.Add(time.Duration(prev.duration*500) * time.Millisecond)
+	listed := synchron.backupSegments(func(v *m3u8.MediaSegment, seq sourceSequence) bool {
+		return v.ProgramDateTime.After(start) && v.ProgramDateTime.Before(first.ProgramDateTime.Add(-time.Second))
+	})
+	var backfill []*m3u8.MediaSegment
+	for _, v := range listed {
+		backfill = append(backfill, v)
+	}
+	sortSegments(backfill)
+	max := synchron.option.Download.Backfill
+	if uint64(max) > seqNo {
+		max = int(seqNo)
+	}
+	if len(backfill) > max {
+		backfill = backfill[len(backfill)-max:]
+	}
+	return backfill
+}
+
+// backupSegments returns segments matched on sources other than the active one, by media sequence, with absolute URIs.
+// Backup playlists are loaded in parallel, those not loaded within backfillTimeout are skipped.
+func (synchron *Synchronizer) backupSegments(match func(v *m3u8.MediaSegment, seq sourceSequence) bool) map[uint64]*m3u8.MediaSegment {
+	type backupPlaylist struct {
+		mpl  *m3u8.MediaPlaylist
+		resp *http.Response
+		seq  sourceSequence
+	}
+	ctx, cancel := context.WithTimeout(synchron.pollCtx, backfillTimeout)
+	defer cancel()
+	active, _ := synchron.sources.current()
+	backups := make([]*backupPlaylist, synchron.sources.count())
+	var wg sync.WaitGroup
+	for idx := range backups {
+		if idx == active {
+			continue
+		}
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			mpl, resp, _, seq, e := synchron.loadPlaylist(ctx, synchron.sourceURL(idx), make(map[string]*resolvedVariant), nil)
+			if nil != e {
+				log.Debugf("Load backup playlist for backfilling failed:> %s \n", e)
+				return
+			}
+			backups[idx] = &backupPlaylist{mpl: mpl, resp: resp, seq: seq}
+		}(idx)
+	}
+	wg.Wait()
+	found := make(map[uint64]*m3u8.MediaSegment)
+	for _, backup := range backups {
+		if nil == backup {
+			continue
+		}
+		mpl, resp, seq := backup.mpl, backup.resp, backup.seq
+		var key *m3u8.Key
+		var init *m3u8.Map
+		for i, v := range decodedSegments(mpl) {
+			v.SeqId = mpl.SeqNo + uint64(i)
+			if v.Discontinuity {
+				seq.discontinuity++
+			}
+			if nil != v.Key {
+				key = v.Key
+			}
+			if nil != v.Map {
+				init = v.Map
+			}
+			if _, ok := found[v.SeqId]; ok || !match(v, seq) {
+				continue
+			}
+			if u, e := resp.Request.URL.Parse(v.URI); nil == e {
+				v.URI = synchron.withTokens(resp.Request.URL, u.String())
+			}
+			v.Key, v.Map, v.Discontinuity = absoluteKey(key, resp), absoluteMap(init, resp), false
+			found[v.SeqId] = v
+		}
+	}
+	return found
+}
+
+func absoluteKey(key *m3u8.Key, resp *http.Response) *m3u8.Key {
+	if nil == key || key.URI == "" {
+		return key
+	}
+	abs := *key
+	if u, e := resp.Request.URL.Parse(key.URI); nil == e {
+		abs.URI = u.String()
+	}
+	return &abs
+}
+
+func absoluteMap(m *m3u8.Map, resp *http.Response) *m3u8.Map {
+	if nil == m {
+		return nil
+	}
+	abs := *m
+	if u, e := resp.Request.URL.Parse(m.URI); nil == e {
+		abs.URI = u.String()
+	}
+	return &abs
+}
+
+// sortSegments sorts segments by media sequence.
+func sortSegments(segments []*m3u8.MediaSegment) {
+	for i := 1; i < len(segments); i++ {
+		for j := i; j > 0 && segments[j].SeqId < segments[j-1].SeqId; j-- {
+			segments[j], segments[j-1] = segments[j-1], segments[j]
+		}
+	}
+}
+
+// guessURI derives the URI of segment seq from URIs of segments a and b numbered by media sequence, like 'seg1234.ts'
+// or 'seg01234.ts?token=...'. The query of a is kept. Empty if no number in path of a makes the path of b.
+func guessURI(a, b *m3u8.MediaSegment, seq uint64) string {
+	path := strings.SplitN(a.URI, "?", 2)[0]
+	pathB := strings.SplitN(b.URI, "?", 2)[0]
+	for i := 0; i < len(path); {
+		if path[i] < '0' || path[i] > '9' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(path) && path[j] >= '0' && path[j] <= '9' {
+			j++
+		}
+		if n, e := strconv.ParseUint(path[i:j], 10, 64); nil == e && n == a.SeqId {
+			number := func(n uint64) string {
+				if path[i] == '0' && j-i > 1 {
+					return fmt.Sprintf("%0*d", j-i, n)
+				}
+				return strconv.FormatUint(n, 10)
+			}
+			if path[:i]+number(b.SeqId)+path[j:] == pathB {
+				return a.URI[:i] + number(seq) + a.URI[j:]
+			}
+		}
+		i = j
+	}
+	return ""
+}
+
+// gapPending is called before a segment backfilled of gap is queued, which is downloaded meanwhile.
+func (synchron *Synchronizer) gapPending(gap *GapEntry) {
+	synchron.gapLog.Lock()
+	gap.pending++
+	synchron.gapLog.Unlock()
+}
+
+// gapQueued is called after segments backfilled of gap are queued, pending of them are not downloaded yet.
+func (synchron *Synchronizer) gapQueued(gap *GapEntry) {
+	synchron.gapLog.Lock()
+	gap.queued = true
+	done := gap.pending == 0
+	synchron.gapLog.Unlock()
+	if done {
+		synchron.writeGap(gap)
+	}
+}
+
+// gapFilled is called when a segment backfilled of gap is downloaded or failed.
+func (synchron *Synchronizer) gapFilled(gap *GapEntry, ok bool) {
+	synchron.gapLog.Lock()
+	gap.pending--
+	if ok {
+		gap.Backfilled++
+	} else {
+		gap.Failed++
+	}
+	done := gap.queued && gap.pending == 0
+	synchron.gapLog.Unlock()
+	if done {
+		synchron.writeGap(gap)
+	}
+}
+
+func (synchron *Synchronizer) writeGap(gap *GapEntry) {
+	fields := map[string]interface{}{"reason": gap.Reason, "missing": gap.Missing, "backfilled": gap.Backfilled}
+	if gap.Reason == GAP_SEQUENCE {
+		synchron.emit(EVENT_GAP, fields, "%d segments missing (%d - %d), %d backfilled", gap.Missing, gap.From, gap.To, gap.Backfilled)
+	} else {
+		synchron.emit(EVENT_GAP, fields, "Missing %s - %s, %d segments backfilled", gap.Start, gap.End, gap.Backfilled)
+	}
+	l := synchron.gapLog
+	if l.filename == "" {
+		return
+	}
+	data, e := json.Marshal(gap)
+	if nil != e {
+		log.Errorf("Encode gap failed:> %s \n", e)
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if e = os.MkdirAll(filepath.Dir(l.filename), 0777); nil != e {
+		log.Errorf("Create directory '%s' failed:> %s \n", filepath.Dir(l.filename), e)
+		return
+	}
+	f, e := os.OpenFile(l.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if nil != e {
+		log.Errorf("Open gap log '%s' failed:> %s \n", l.filename, e)
+		return
+	}
+	defer f.Close()
+	if _, e = f.Write(append(data, '\n')); nil != e {
+		log.Errorf("Write gap log '%s' failed:> %s \n", l.filename, e)
+	}
+}
+
+// Gaps returns gaps in the gap log overlapping start and end, by their timestamps or when they were detected.
+func (synchron *Synchronizer) Gaps(start time.Time, end time.Time) ([]*GapEntry, error) {
+	gaps := []*GapEntry{}
+	l := synchron.gapLog
+	if l.filename == "" {
+		return gaps, nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	f, e := os.Open(l.filename)
+	if os.IsNotExist(e) {
+		return gaps, nil
+	} else if nil != e {
+		return nil, e
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		gap := &GapEntry{}
+		if e := json.Unmarshal(scanner.Bytes(), gap); nil != e {
+			continue
+		}
+		from, to := gap.Start, gap.End
+		if to.IsZero() {
+			to = gap.Detected
+		}
+		if from.IsZero() {
+			from = to
+		}
+		if !to.Before(start) && !from.After(end) {
+			gaps = append(gaps, gap)
+		}
+	}
+	return gaps, scanner.Err()
+}
+
+// serveGaps responds the gaps between query parameters 'start' and 'end' in unix timestamps, all if not given.
+func (synchron *Synchronizer) serveGaps(response http.ResponseWriter, request *http.Request) {
+	start, end := time.Unix(0, 0), time.Now()
+	for name, t := range map[string]*time.Time{"start": &start, "end": &end} {
+		if s := request.URL.Query().Get(name); s != "" {
+			sec, e := strconv.ParseInt(s, 10, 64)
+			if nil != e {
+				response.WriteHeader(400)
+				response.Write([]byte(fmt.Sprintf("Invalid '%s' parameter: '%s' \n", name, s)))
+				return
+			}
+			*t = time.Unix(sec, 0)
+		}
+	}
+	gaps, e := synchron.Gaps(start, end)
+	if nil != e {
+		log.Errorf("Read gap log failed:> %s \n", e)
+		response.WriteHeader(500)
+		response.Write([]byte(fmt.Sprintf("Read gap log failed:> %s", e)))
+		return
+	}
+	body, _ := json.MarshalIndent(gaps, "", "  ")
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	response.Write(body)
+}
@@ -0,0 +1,297 @@
+/**
+This source file contains the health scoring of source URLs and the failover between them.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+)
+
+const (
+	// Weight of the latest sample in the moving average of health scores.
+	healthWeight = 0.3
+	// A source is stale when media sequence did not advance in this many target durations.
+	staleFactor = 3
+)
+
+// sourceHealth is the health of one source URL, scored from 0 (dead) to 100 (healthy).
+type sourceHealth struct {
+	url          string
+	score        float64
+	failures     int       // Consecutive playlist failures.
+	lastEnd      uint64    // Media sequence after the last segment of latest playlist.
+	lastChange   time.Time // Last time the media sequence advanced.
+	healthySince time.Time // Since when the score is continuously above failover score, zero if not.
+	polls        PollStats
+	resolved     string    // URL resolved by resolver, empty if not yet.
+	expires      time.Time // When the signature of resolved URL expires, zero if unknown.
+	resolvedAt   time.Time // Last time of resolving.
+	denied       bool      // Source denied a request since resolved.
+}
+
+type sourceSet struct {
+	sync.Mutex
+	synchron *Synchronizer
+	sources  []*sourceHealth
+	active   int
+	switched time.Time
+}
+
+func newSourceSet(synchron *Synchronizer, urls []string) *sourceSet {
+	set := &sourceSet{synchron: synchron, switched: time.Now()}
+	for _, u := range urls {
+		set.sources = append(set.sources, &sourceHealth{url: u, score: 100, lastChange: time.Now(), healthySince: time.Now()})
+	}
+	return set
+}
+
+// current returns the index and URL of active source.
+func (set *sourceSet) current() (int, string) {
+	set.Lock()
+	defer set.Unlock()
+	return set.active, set.sources[set.active].url
+}
+
+func (set *sourceSet) url(idx int) string {
+	set.Lock()
+	defer set.Unlock()
+	if h := set.at(idx); nil != h {
+		return h.url
+	}
+	return ""
+}
+
+// at returns source idx, nil when it is out of range as sources were replaced meanwhile. Caller holds the lock.
+func (set *sourceSet) at(idx int) *sourceHealth {
+	if idx < 0 || idx >= len(set.sources) {
+		return nil
+	}
+	return set.sources[idx]
+}
+
+// replace replaces the source URLs, sources kept keep their health. The active source stays active when it is kept,
+// otherwise the first one is activated.
+func (set *sourceSet) replace(urls []string) {
+	set.Lock()
+	defer set.Unlock()
+	active := set.sources[set.active].url
+	known := make(map[string]*sourceHealth)
+	for _, h := range set.sources {
+		known[h.url] = h
+	}
+	sources := make([]*sourceHealth, 0, len(urls))
+	set.active = -1
+	for i, u := range urls {
+		h, ok := known[u]
+		if ok {
+			delete(known, u)
+		} else {
+			h = &sourceHealth{url: u, score: 100, lastChange: time.Now(), healthySince: time.Now()}
+		}
+		if u == active && set.active < 0 {
+			set.active = i
+		}
+		sources = append(sources, h)
+	}
+	set.sources = sources
+	if set.active < 0 {
+		set.active = 0
+		set.switched = time.Now()
+		log.Warningf("Active source removed, switched to:> %s \n", sources[0].url)
+	}
+}
+
+func (set *sourceSet) count() int {
+	set.Lock()
+	defer set.Unlock()
+	return len(set.sources)
+}
+
+// sample feeds a new sample into the score of a source, caller holds the lock.
+func (set *sourceSet) sample(h *sourceHealth, value float64) {
+	h.score = h.score*(1-healthWeight) + value*healthWeight
+	if h.score >= float64(set.synchron.option.Source.FailoverScore) {
+		if h.healthySince.IsZero() {
+			h.healthySince = time.Now()
+		}
+	} else {
+		h.healthySince = time.Time{}
+	}
+}
+
+// playlistFetched reports a playlist loaded from source, end is the media sequence after its last segment.
+func (set *sourceSet) playlistFetched(idx int, end uint64, targetDuration float64) {
+	set.Lock()
+	defer set.Unlock()
+	h := set.at(idx)
+	if nil == h {
+		return
+	}
+	h.failures = 0
+	if end > h.lastEnd {
+		h.lastEnd = end
+		h.lastChange = time.Now()
+		set.sample(h, 100)
+	} else if time.Now().Sub(h.lastChange) > time.Duration(targetDuration*staleFactor*1000)*time.Millisecond {
+		log.Warningf("Source is stale, media sequence stopped at %d:> %s \n", h.lastEnd, h.url)
+		set.sample(h, 20)
+	} else {
+		set.sample(h, 100)
+	}
+	set.evaluate()
+}
+
+// playlistFailed reports a failure of loading playlist from source.
+func (set *sourceSet) playlistFailed(idx int) {
+	set.Lock()
+	defer set.Unlock()
+	h := set.at(idx)
+	if nil == h {
+		return
+	}
+	h.failures++
+	set.sample(h, 0)
+	set.evaluate()
+}
+
+// segmentDownloaded reports the result of downloading a segment from source.
+func (set *sourceSet) segmentDownloaded(idx int, ok bool) {
+	set.Lock()
+	defer set.Unlock()
+	h := set.at(idx)
+	if nil == h {
+		return
+	}
+	if ok {
+		set.sample(h, 100)
+	} else {
+		set.sample(h, 0)
+	}
+	set.evaluate()
+}
+
+// evaluate switches to the best backup when active source degraded, or back to primary when it is stable again.
+// Caller holds the lock.
+func (set *sourceSet) evaluate() {
+	if len(set.sources) < 2 || set.synchron.alternates != nil {
+		// Redundant sources are all polled, there is no active one to switch.
+		return
+	}
+	option := &set.synchron.option.Source
+	active := set.sources[set.active]
+	if active.failures >= set.synchron.option.Retries || active.score < float64(option.FailoverScore) {
+		best := -1
+		for i, h := range set.sources {
+			if i != set.active && h.failures < set.synchron.option.Retries && (best < 0 || h.score > set.sources[best].score) {
+				best = i
+			}
+		}
+		if best >= 0 && (active.failures >= set.synchron.option.Retries || set.sources[best].score > active.score) {
+			set.switchTo(best, EVENT_FAILOVER)
+		} else if best < 0 && active.failures >= set.synchron.option.Retries {
+			// Backups failed before are not polled since, their failures are stale: the next one is tried in turn.
+			set.switchTo((set.active+1)%len(set.sources), EVENT_FAILOVER)
+		}
+		return
+	}
+	if set.active != 0 && option.FailbackAfter > 0 {
+		primary := set.sources[0]
+		if !primary.healthySince.IsZero() && time.Now().Sub(primary.healthySince) >= time.Duration(option.FailbackAfter)*time.Second {
+			set.switchTo(0, EVENT_FAILBACK)
+		}
+	}
+}
+
+// switchTo activates another source, caller holds the lock.
+func (set *sourceSet) switchTo(idx int, typ string) {
+	from := set.sources[set.active]
+	to := set.sources[idx]
+	set.active = idx
+	set.switched = time.Now()
+	to.failures = 0
+	set.synchron.emit(typ, map[string]interface{}{
+		"from":       from.url,
+		"from_score": int(from.score),
+		"to":         to.url,
+		"to_score":   int(to.score),
+	}, "Switched source from %s (score %d) to %s (score %d)", from.url, int(from.score), to.url, int(to.score))
+}
+
+// probeProc probes inactive sources in background, so their health is known before switching to them.
+func (synchron *Synchronizer) probeProc() {
+	interval := time.Duration(synchron.option.Source.ProbeInterval) * time.Second
+	if interval <= 0 || synchron.sources.count() < 2 || synchron.alternates != nil {
+		return
+	}
+	for {
+		select {
+		case <-synchron.quit:
+			return
+		case <-time.After(interval):
+		}
+		active, _ := synchron.sources.current()
+		for idx := 0; idx < synchron.sources.count(); idx++ {
+			if idx == active {
+				continue
+			}
+			mpl, e := synchron.probeSource(synchron.sourceURL(idx))
+			synchron.sources.probed(idx, e)
+			synchron.sourceDenied(idx, e)
+			if nil != e {
+				log.Debugf("Probe source failed:> %s : %s \n", synchron.sources.url(idx), e)
+				synchron.sources.playlistFailed(idx)
+			} else {
+				synchron.sources.playlistFetched(idx, mpl.SeqNo+uint64(mpl.Count()), mpl.TargetDuration)
+			}
+		}
+	}
+}
+
+// probeSource loads media playlist of a source, following the selected variant if it is a master playlist.
+func (synchron *Synchronizer) probeSource(urlStr string) (*m3u8.MediaPlaylist, error) {
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", urlStr, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(synchron.pollCtx)
+		resp, err := synchron.doRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, &httpStatusError{code: resp.StatusCode, what: "playlist"}
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(respBody), true, synchron.option.ProgramTimeFormat, synchron.program_timezone)
+		if err != nil {
+			return nil, err
+		}
+		if listType == m3u8.MEDIA {
+			return playlist.(*m3u8.MediaPlaylist), nil
+		}
+		variant, err := selectVariant(playlist.(*m3u8.MasterPlaylist), &synchron.option.Source)
+		if err != nil {
+			return nil, err
+		}
+		variantUrl, err := resp.Request.URL.Parse(variant.URI)
+		if err != nil {
+			return nil, err
+		}
+		urlStr = synchron.withTokens(resp.Request.URL, variantUrl.String())
+	}
+	return nil, errors.New("no media playlist")
+}
@@ -0,0 +1,153 @@
+/**
+This source file contains the reloading of configuration on SIGHUP: options safe to change are applied live, others
+changed are reported as requiring a restart.
+*/
+package main
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Options applied live by Reload, by their paths in Option.
+var liveOptions = map[string]bool{
+	"LogLevel":                 true,
+	"UserAgent":                true,
+	"Source.Urls":              true,
+	"Source.Auth":              true,
+	"Http.Days":                true,
+	"Http.Max":                 true,
+	"Http.CacheNum":            true,
+	"Http.CacheValid":          true,
+	"Record.TimeshiftDuration": true,
+}
+
+// changedOptions appends paths of fields differing between options a and b, fields of nested structs are compared
+// one by one.
+func changedOptions(changed []string, prefix string, a, b reflect.Value) []string {
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if field.Tag.Get("toml") == "-" {
+			continue
+		}
+		name := prefix + field.Name
+		if field.Type.Kind() == reflect.Struct {
+			changed = changedOptions(changed, name+".", a.Field(i), b.Field(i))
+		} else if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// checkOption validates options the same way as NewSynchronizer does, without side effects.
+func checkOption(option *Option) error {
+	if len(option.Source.Urls) < 1 {
+		return errors.New("at least one source URL is required")
+	}
+	if _, e := parseVariantPolicy(option.Source.VariantPolicy); nil != e {
+		return e
+	}
+	if _, e := parseEncryptMethod(option.Encrypt.Method); nil != e {
+		return e
+	}
+	if mode, e := parseSourceMode(option.Source.Mode); nil != e {
+		return e
+	} else if mode == SM_REDUNDANT {
+		if _, e := parseAlignBy(option.Source.AlignBy); nil != e {
+			return e
+		}
+	}
+	if _, e := parseDedupBy(option.Source.DedupBy); nil != e {
+		return e
+	}
+	if _, e := time.LoadLocation(option.ProgramTimezone); nil != e {
+		return e
+	}
+	if _, e := log.ParseLevel(option.LogLevel); nil != e {
+		return e
+	}
+	if _, e := loadAuths(option.Source.Auth); nil != e {
+		return e
+	}
+	for _, network := range option.Source.Network {
+		if _, e := newTransport(network); nil != e {
+			return e
+		}
+	}
+	return nil
+}
+
+// Reload applies options safe to change live, and returns paths of other options changed, which require a restart.
+// Nothing is applied when option is invalid.
+func (synchron *Synchronizer) Reload(option *Option) ([]string, error) {
+	if e := checkOption(option); nil != e {
+		return nil, e
+	}
+	auths, e := loadAuths(option.Source.Auth)
+	if nil != e {
+		return nil, e
+	}
+	// Sources of redundant mode and ladder are polled by position, and set up only once.
+	urlsLive := nil == synchron.alternates && !synchron.option.Source.Ladder
+	var restart []string
+	synchron.live.Lock()
+	for _, name := range changedOptions(nil, "", reflect.ValueOf(synchron.option).Elem(), reflect.ValueOf(option).Elem()) {
+		if !liveOptions[name] || (name == "Source.Urls" && !urlsLive) {
+			restart = append(restart, name)
+		} else {
+			log.Infof("Reloaded option:> %s \n", name)
+		}
+	}
+	current := synchron.option
+	if urlsLive && !reflect.DeepEqual(current.Source.Urls, option.Source.Urls) {
+		current.Source.Urls = option.Source.Urls
+		synchron.sources.replace(option.Source.Urls)
+	}
+	if current.Http.CacheNum != option.Http.CacheNum {
+		synchron.httpCache.reset(option.Http.CacheNum)
+	}
+	current.LogLevel = option.LogLevel
+	current.UserAgent = option.UserAgent
+	current.Source.Auth = option.Source.Auth
+	current.Http.Days = option.Http.Days
+	current.Http.Max = option.Http.Max
+	current.Http.CacheNum = option.Http.CacheNum
+	current.Http.CacheValid = option.Http.CacheValid
+	current.Record.TimeshiftDuration = option.Record.TimeshiftDuration
+	synchron.auths = auths
+	synchron.live.Unlock()
+	level, _ := log.ParseLevel(option.LogLevel)
+	log.SetLevel(level)
+	for _, r := range synchron.renditions {
+		if nil != r.synchron {
+			// Changes requiring a restart are reported by the ladder already.
+			if _, e := r.synchron.Reload(synchron.renditionOption(r.name, r.synchron.option.Source.Urls)); nil != e {
+				log.Errorf("Reload rendition '%s' failed:> %s \n", r.name, e)
+			}
+		}
+	}
+	return restart, nil
+}
+
+func (synchron *Synchronizer) userAgent() string {
+	synchron.live.RLock()
+	defer synchron.live.RUnlock()
+	return synchron.option.UserAgent
+}
+
+func (synchron *Synchronizer) timeshiftDuration() int {
+	synchron.live.RLock()
+	defer synchron.live.RUnlock()
+	return synchron.option.Record.TimeshiftDuration
+}
+
+// httpOption returns the HTTP options, which are replaced by Reload.
+func (synchron *Synchronizer) httpOption() HttpOption {
+	synchron.live.RLock()
+	defer synchron.live.RUnlock()
+	return synchron.option.Http
+}
@@ -4,6 +4,8 @@
 	GET /?playlist={start-timestamp}_{end-timestamp}.m3u8           eg: /?playlist=1479998100_1480004640.m3u8
 	GET /?start={start-timestamp}&duration={duration-in-seconds}    eg: /?start=1479998100&duration=6540
 	GET /?start={start-timestamp}&end={end-timestamp}               eg: /?start=1479998100&end=1480004640
+	GET /?stats                                                     Poll statistics of sources in JSON.
+	GET /?gaps&start={start-timestamp}&end={end-timestamp}          Gaps detected in JSON, start and end are optional.
  */
 package main
 
@@ -20,6 +22,7 @@ import (
     "os"
     "path/filepath"
     "bytes"
+    "sync"
     "github.com/golang/groupcache/lru"
 )
 
@@ -28,10 +31,48 @@ type CacheItem struct {
     _content   []byte
 }
 
+// playlistCache keeps playlists served, it is shared by concurrent requests and reset by Reload.
+type playlistCache struct {
+    sync.Mutex
+    cache *lru.Cache
+}
+
+func newPlaylistCache(size int) *playlistCache {
+    return &playlistCache{cache: lru.New(size)}
+}
+
+func (c *playlistCache) get(key string) (CacheItem, bool) {
+    c.Lock()
+    defer c.Unlock()
+    if v, ok := c.cache.Get(key); ok {
+        item, yes := v.(CacheItem)
+        return item, yes
+    }
+    return CacheItem{}, false
+}
+
+func (c *playlistCache) add(key string, item CacheItem) {
+    c.Lock()
+    defer c.Unlock()
+    c.cache.Add(key, item)
+}
+
+// reset empties the cache, which keeps up to size playlists from now on.
+func (c *playlistCache) reset(size int) {
+    c.Lock()
+    defer c.Unlock()
+    c.cache = lru.New(size)
+}
+
 func (synchron *Synchronizer) HttpServe() {
-    ls := strings.Split(synchron.option.Http.Listen, "://")
+    serveHttp(synchron.option.Http.Listen, synchron, synchron.quit)
+}
+
+// serveHttp serves handler on listen address until quit is closed.
+func serveHttp(listen string, handler http.Handler, quit chan struct{}) {
+    ls := strings.Split(listen, "://")
     if len(ls) != 2 {
-        log.Errorf("Invalid listen option:> '%s', should use like 'tcp://0.0.0.0:8080' or 'unix:///var/run/test.sock'.", synchron.option.Http.Listen)
+        log.Errorf("Invalid listen option:> '%s', should use like 'tcp://0.0.0.0:8080' or 'unix:///var/run/test.sock'.", listen)
         return
     }
     if ls[0] == "unix" {
@@ -44,13 +85,29 @@ func (synchron *Synchronizer) HttpServe() {
     ln, err := net.Listen(ls[0], ls[1])
     if nil != err {
         log.Errorln("Listen to socket failed:> ", err)
+        return
     }
-    if e := os.Chmod(ls[1], os.ModePerm); nil != e {
-        log.Errorln("Change socket file mode failed:> ", e)
+    if ls[0] == "unix" {
+        if e := os.Chmod(ls[1], os.ModePerm); nil != e {
+            log.Errorln("Change socket file mode failed:> ", e)
+        }
+    }
+    go func() {
+        <-quit
+        ln.Close()
+    }()
+    e := http.Serve(ln, handler)
+    if ls[0] == "unix" {
+        if e := os.Remove(ls[1]); nil != e && !os.IsNotExist(e) {
+            log.Errorf("Remove sock file '%s' failed:> %s \n", ls[1], e)
+        }
+    }
+    select {
+    case <-quit:
+        log.Infoln("HTTP service stopped.")
+    default:
+        log.Errorln("HTTP serve failed:> ", e)
     }
-    synchron.httpCache = lru.New(synchron.option.Http.CacheNum)
-    e := http.Serve(ln, synchron)
-    log.Errorln("HTTP serve failed:> ", e)
 }
 
 func (synchron *Synchronizer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
@@ -64,10 +121,33 @@ func (synchron *Synchronizer) ServeHTTP(response http.ResponseWriter, request *h
         _bad_request("Invalid Request Method!\n")
         return
     }
+    if _, ok := request.URL.Query()["stats"]; ok {
+        target := synchron
+        if rendition := request.URL.Query().Get("rendition"); rendition != "" {
+            if target = synchron.findRendition(rendition); nil == target {
+                _bad_request(fmt.Sprintf("Unknown rendition: '%s' \n", rendition))
+                return
+            }
+        }
+        target.serveStats(response)
+        return
+    }
+    if _, ok := request.URL.Query()["gaps"]; ok {
+        target := synchron
+        if rendition := request.URL.Query().Get("rendition"); rendition != "" {
+            if target = synchron.findRendition(rendition); nil == target {
+                _bad_request(fmt.Sprintf("Unknown rendition: '%s' \n", rendition))
+                return
+            }
+        }
+        target.serveGaps(response, request)
+        return
+    }
     playlist := request.URL.Query().Get("playlist")
     start := request.URL.Query().Get("start")
     duration := request.URL.Query().Get("duration")
     end := request.URL.Query().Get("end")
+    rendition := request.URL.Query().Get("rendition")
     var _start_time, _end_time time.Time
     if playlist != "" {
         re := regexp.MustCompile("([0-9]+)[-_]([0-9]+).m3u8")
@@ -108,31 +188,46 @@ func (synchron *Synchronizer) ServeHTTP(response http.ResponseWriter, request *h
         _bad_request("Unknown Query Parameter!\n")
         return
     }
+    httpOption := synchron.httpOption()
     // Need: Start Timestamp, End Timestamp
     if _start_time.After(_end_time) || _start_time.Equal(_end_time) {
         _bad_request("Start timestamp can not be after end timestamp or as the same as end timestamp.!!!\n")
         return
-    } else if time.Now().Sub(_start_time) > time.Duration(synchron.option.Http.Days*24)*time.Hour {
-        _bad_request(fmt.Sprintf("Can not provide shifting before %d days!", synchron.option.Http.Days))
+    } else if time.Now().Sub(_start_time) > time.Duration(httpOption.Days*24)*time.Hour {
+        _bad_request(fmt.Sprintf("Can not provide shifting before %d days!", httpOption.Days))
         return
-    } else if _end_time.Sub(_start_time) > time.Duration(synchron.option.Http.Max)*time.Hour {
-        _bad_request(fmt.Sprintf("Can not provide playlist larger than %d hours!", synchron.option.Http.Max))
+    } else if _end_time.Sub(_start_time) > time.Duration(httpOption.Max)*time.Hour {
+        _bad_request(fmt.Sprintf("Can not provide playlist larger than %d hours!", httpOption.Max))
         return
     }
-    log.Infof("Request Playlist %s -> %s \n", _start_time, _end_time)
-    c_key := fmt.Sprintf("%d-%d", _start_time.Unix(), _end_time.Unix())
-    if v, ok := synchron.httpCache.Get(c_key); ok {
+    target := synchron
+    if rendition != "" {
+        if target = synchron.findRendition(rendition); nil == target {
+            _bad_request(fmt.Sprintf("Unknown rendition: '%s' \n", rendition))
+            return
+        }
+    }
+    log.Infof("Request Playlist %s -> %s %s \n", _start_time, _end_time, rendition)
+    c_key := fmt.Sprintf("%d-%d-%s", _start_time.Unix(), _end_time.Unix(), rendition)
+    if item, ok := synchron.httpCache.get(c_key); ok {
         log.Debugln("Cached: ", c_key)
-        if item, yes := v.(CacheItem); yes {
-            if item._timestamp.Add(time.Duration(synchron.option.Http.CacheValid) * time.Second).After(time.Now()) {
-                response.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-                response.Header().Set("Content-Length", fmt.Sprintf("%d", len(item._content)))
-                response.Write(item._content)
-                return
-            }
+        if item._timestamp.Add(time.Duration(httpOption.CacheValid) * time.Second).After(time.Now()) {
+            response.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+            response.Header().Set("Content-Length", fmt.Sprintf("%d", len(item._content)))
+            response.Write(item._content)
+            return
         }
     }
-    if mpl, e := synchron.buildPlaylist(_start_time, _end_time); e != nil {
+    if synchron.renditions != nil && rendition == "" {
+        // Ladder: master playlist pointing to playlists of each rendition in the same time range.
+        pbytes := synchron.localMaster(func(name string) string {
+            return fmt.Sprintf("%s?start=%d&end=%d&rendition=%s", request.URL.Path, _start_time.Unix(), _end_time.Unix(), name)
+        }).Encode().Bytes()
+        response.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+        response.Header().Set("Content-Length", fmt.Sprintf("%d", len(pbytes)))
+        response.Write(pbytes)
+        synchron.httpCache.add(c_key, CacheItem{_timestamp: time.Now(), _content: pbytes})
+    } else if mpl, e := target.buildPlaylist(_start_time, _end_time); e != nil {
         log.Errorf("Build playlist failed:> %s \n", e)
         response.WriteHeader(500)
         response.Header().Set("Content-Type", "text/plain")
@@ -140,12 +235,12 @@ func (synchron *Synchronizer) ServeHTTP(response http.ResponseWriter, request *h
         return
     } else {
         buf := &bytes.Buffer{}
-        mpl.Encode().WriteTo(buf)
+        encodePlaylist(mpl, 0, nil, nil).WriteTo(buf)
         pbytes := buf.Bytes()
         response.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
         response.Header().Set("Content-Length", fmt.Sprintf("%d", len(pbytes)))
         response.Write(pbytes)
-        synchron.httpCache.Add(c_key, CacheItem{_timestamp: time.Now(), _content: pbytes})
+        synchron.httpCache.add(c_key, CacheItem{_timestamp: time.Now(), _content: pbytes})
     }
 }
 
@@ -161,6 +256,7 @@ func (synchron *Synchronizer) buildPlaylist(start time.Time, end time.Time) (*m3
         log.Errorf("Create MediaPlaylist failed:> %s\n", e)
         return nil, e
     }
+    var last *m3u8.MediaSegment
     for t := start.Truncate(duration); t.Before(end); t = t.Add(duration) {
         log.Debugln("T:>", t)
         if index_filename, e := synchron.generateFilename(synchron.option.Record.Output, synchron.option.Record.ReindexFormat, t, 0); nil != e {
@@ -169,18 +265,15 @@ func (synchron *Synchronizer) buildPlaylist(start time.Time, end time.Time) (*m3
         } else {
             rl_idx, _ := synchron.generateFilename(synchron.option.Http.SegmentPrefix, synchron.option.Record.ReindexFormat, t, 0)
             rl_path := filepath.Dir(rl_idx)
-            fp, e := os.Open(index_filename)
+            index_mpl, _, e := synchron.readMediaPlaylist(index_filename)
             if nil != e {
-                log.Errorf("Open index file '%s' failed:> %s \n", index_filename, e)
+                log.Errorf("Read index file '%s' failed:> %s \n", index_filename, e)
                 continue
             }
-            l, t, e := m3u8.DecodeFrom(fp, true,"", synchron.program_timezone)
-            fp.Close()
-            if nil != e || t != m3u8.MEDIA {
-                log.Errorf("Decode index file '%s' failed:> %s \n", index_filename, e)
-                continue
-            }
-            index_mpl := l.(*m3u8.MediaPlaylist)
+            // Keys of encrypted segments, with URI relative to the index playlist rewritten.
+            keys := make(map[*m3u8.Key]*m3u8.Key)
+            // Initialization sections of fMP4 segments, rewritten the same way.
+            maps := make(map[*m3u8.Map]*m3u8.Map)
             for _, seg := range index_mpl.Segments {
                 if nil == seg {
                     continue
@@ -190,6 +283,37 @@ func (synchron *Synchronizer) buildPlaylist(start time.Time, end time.Time) (*m3
                     continue
                 }
                 seg.URI = filepath.ToSlash(filepath.Join(rl_path, seg.URI))
+                if nil != seg.Key {
+                    if key, ok := keys[seg.Key]; ok {
+                        seg.Key = key
+                    } else {
+                        key := *seg.Key
+                        if !strings.Contains(key.URI, "://") && !strings.HasPrefix(key.URI, "/") {
+                            key.URI = filepath.ToSlash(filepath.Join(rl_path, key.URI))
+                        }
+                        keys[seg.Key] = &key
+                        seg.Key = &key
+                    }
+                }
+                // Segments joined from index files are discontinuous where the recording was interrupted.
+                if nil == last {
+                    seg.Discontinuity = false
+                } else if isGap(last, seg.ProgramDateTime) {
+                    seg.Discontinuity = true
+                }
+                last = seg
+                if nil != seg.Map {
+                    if m, ok := maps[seg.Map]; ok {
+                        seg.Map = m
+                    } else {
+                        m := *seg.Map
+                        if !strings.Contains(m.URI, "://") && !strings.HasPrefix(m.URI, "/") {
+                            m.URI = filepath.ToSlash(filepath.Join(rl_path, m.URI))
+                        }
+                        maps[seg.Map] = &m
+                        seg.Map = &m
+                    }
+                }
                 mpl.AppendSegment(seg)
                 mpl.TargetDuration = seg.Duration
             }
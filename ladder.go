@@ -0,0 +1,338 @@
+/**
+This source file contains the ladder mode, which follows all renditions of a master playlist.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+)
+
+// rendition is one media playlist of a ladder, followed by its own Synchronizer.
+type rendition struct {
+	name        string
+	variant     *m3u8.Variant     // Set for EXT-X-STREAM-INF renditions.
+	alternative *m3u8.Alternative // Set for EXT-X-MEDIA renditions.
+	synchron    *Synchronizer
+}
+
+// ladderClock shares timestamps of segments without PROGRAM-DATE-TIME by media sequence, so renditions are indexed
+// with aligned timestamps. Variants number segments alike, while EXT-X-MEDIA renditions may have segments of other
+// durations numbered their own way: they are aligned only when their target duration is the one of variants.
+type ladderClock struct {
+	sync.Mutex
+	stamps map[uint64]time.Time
+	keep   uint64
+	max    uint64
+	target float64 // Target duration of variants.
+}
+
+func newLadderClock(keep int) *ladderClock {
+	if keep < 1 {
+		keep = 1
+	}
+	return &ladderClock{stamps: make(map[uint64]time.Time), keep: uint64(keep) * 4}
+}
+
+// align returns the timestamp of given media sequence, the first variant reporting it wins. EXT-X-MEDIA renditions
+// take timestamps of variants, they keep their own t when variants have not reported the sequence yet.
+func (c *ladderClock) align(seq uint64, t time.Time, target float64, variant bool) time.Time {
+	c.Lock()
+	defer c.Unlock()
+	if !variant {
+		if v, ok := c.stamps[seq]; ok && target == c.target {
+			return v
+		}
+		return t
+	}
+	if c.target == 0 {
+		c.target = target
+	}
+	if v, ok := c.stamps[seq]; ok {
+		return v
+	}
+	c.stamps[seq] = t
+	if seq > c.max {
+		c.max = seq
+		for k := range c.stamps {
+			if k+c.keep < c.max {
+				delete(c.stamps, k)
+			}
+		}
+	}
+	return t
+}
+
+// fetchMaster loads the master playlist from given URL.
+func (synchron *Synchronizer) fetchMaster(urlStr string) (*m3u8.MasterPlaylist, *http.Response, error) {
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(synchron.pollCtx)
+	resp, err := synchron.doRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	playlist, listType, err := m3u8.Decode(*bytes.NewBuffer(respBody), true, synchron.option.ProgramTimeFormat, synchron.program_timezone)
+	if err != nil {
+		return nil, nil, err
+	}
+	if listType != m3u8.MASTER {
+		return nil, nil, errors.New("not a master playlist")
+	}
+	return playlist.(*m3u8.MasterPlaylist), resp, nil
+}
+
+// renditionOption derives the options of a rendition from the options of the ladder.
+func (synchron *Synchronizer) renditionOption(name string, urls []string) *Option {
+	option := *synchron.option
+	option.Source.Urls = urls
+	option.Source.Ladder = false
+	// URLs of renditions are resolved from master playlists, not by resolver.
+	option.Source.Resolver = ""
+	option.Sync.Output = filepath.Join(synchron.option.Sync.Output, name)
+	option.Record.Output = filepath.Join(synchron.option.Record.Output, name)
+	option.Http.Enabled = false
+	if option.Http.SegmentPrefix != "" {
+		option.Http.SegmentPrefix = strings.TrimSuffix(option.Http.SegmentPrefix, "/") + "/" + name
+	} else {
+		option.Http.SegmentPrefix = name
+	}
+	return &option
+}
+
+// setupLadder resolves the master playlists and creates one Synchronizer per rendition.
+func (synchron *Synchronizer) setupLadder() error {
+	var masters []*m3u8.MasterPlaylist
+	var responses []*http.Response
+	for len(masters) < 1 {
+		for i := range synchron.option.Source.Urls {
+			urlStr := synchron.sourceURL(i)
+			if master, resp, e := synchron.fetchMaster(urlStr); nil != e {
+				log.Errorf("Load master playlist '%s' failed:> %s \n", urlStr, e)
+			} else {
+				masters = append(masters, master)
+				responses = append(responses, resp)
+			}
+		}
+		if len(masters) < 1 {
+			if synchron.halted() {
+				return errors.New("stopped before master playlist loaded")
+			}
+			time.Sleep(time.Duration(1) * time.Second)
+		}
+	}
+	// Renditions are matched by position across masters of backup sources.
+	_urls := func(uri func(master *m3u8.MasterPlaylist) string) []string {
+		var urls []string
+		for i, master := range masters {
+			if u := uri(master); u != "" {
+				if abs, e := responses[i].Request.URL.Parse(u); nil == e {
+					urls = append(urls, synchron.withTokens(responses[i].Request.URL, abs.String()))
+				}
+			}
+		}
+		return urls
+	}
+	var variants []*m3u8.Variant
+	for _, v := range masters[0].Variants {
+		if v != nil && !v.Iframe && v.URI != "" {
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) < 1 {
+		return errors.New("no variant in master playlist")
+	}
+	for i, v := range variants {
+		idx := i
+		r := &rendition{name: fmt.Sprintf("variant-%d", idx), variant: v}
+		urls := _urls(func(master *m3u8.MasterPlaylist) string {
+			n := 0
+			for _, mv := range master.Variants {
+				if mv != nil && !mv.Iframe && mv.URI != "" {
+					if n == idx {
+						return mv.URI
+					}
+					n++
+				}
+			}
+			return ""
+		})
+		if e := synchron.addRendition(r, urls); nil != e {
+			return e
+		}
+		synchron.renditions = append(synchron.renditions, r)
+	}
+	// EXT-X-MEDIA renditions, deduplicated the same way as they are encoded.
+	counters := make(map[string]int)
+	written := make(map[string]bool)
+	for _, v := range masters[0].Variants {
+		if v == nil {
+			continue
+		}
+		for _, alt := range v.Alternatives {
+			altKey := fmt.Sprintf("%s-%s-%s-%s", alt.Type, alt.GroupId, alt.Name, alt.Language)
+			if written[altKey] {
+				continue
+			}
+			written[altKey] = true
+			r := &rendition{alternative: alt}
+			if alt.URI != "" {
+				typ := strings.ToLower(alt.Type)
+				r.name = fmt.Sprintf("%s-%d", typ, counters[typ])
+				counters[typ]++
+				if e := synchron.addRendition(r, _urls(func(master *m3u8.MasterPlaylist) string {
+					for _, mv := range master.Variants {
+						if mv == nil {
+							continue
+						}
+						for _, ma := range mv.Alternatives {
+							if ma.Type == alt.Type && ma.GroupId == alt.GroupId && ma.Name == alt.Name && ma.Language == alt.Language {
+								return ma.URI
+							}
+						}
+					}
+					return ""
+				})); nil != e {
+					return e
+				}
+			}
+			synchron.renditions = append(synchron.renditions, r)
+		}
+	}
+	return nil
+}
+
+func (synchron *Synchronizer) addRendition(r *rendition, urls []string) error {
+	option := synchron.renditionOption(r.name, urls)
+	if option.Sync.Enabled {
+		if e := os.MkdirAll(option.Sync.Output, 0777); nil != e {
+			return e
+		}
+	}
+	if option.Record.Enabled {
+		if e := os.MkdirAll(option.Record.Output, 0777); nil != e {
+			return e
+		}
+	}
+	s, e := NewSynchronizer(option)
+	if nil != e {
+		return e
+	}
+	s.clock = synchron.clock
+	s.variant = nil != r.variant
+	// Renditions share the rate limit of the channel.
+	s.limiter = synchron.limiter
+	if synchron.name != "" {
+		s.name = synchron.name + "/" + r.name
+	} else {
+		s.name = r.name
+	}
+	r.synchron = s
+	log.Infof("Ladder rendition:> %s | %s \n", r.name, strings.Join(urls, " "))
+	return nil
+}
+
+// localMaster generates a master playlist for the ladder, URIs of renditions are generated by uri.
+func (synchron *Synchronizer) localMaster(uri func(name string) string) *m3u8.MasterPlaylist {
+	master := m3u8.NewMasterPlaylist()
+	var alternatives []*m3u8.Alternative
+	for _, r := range synchron.renditions {
+		if r.alternative != nil {
+			alt := *r.alternative
+			if r.synchron != nil {
+				alt.URI = uri(r.name)
+			}
+			alternatives = append(alternatives, &alt)
+		}
+	}
+	for _, r := range synchron.renditions {
+		if r.variant != nil {
+			params := r.variant.VariantParams
+			params.Alternatives = alternatives
+			alternatives = nil
+			master.Append(uri(r.name), nil, params)
+		}
+	}
+	return master
+}
+
+func (synchron *Synchronizer) saveMasterPlaylist(filename string, master *m3u8.MasterPlaylist) {
+	if e := ioutil.WriteFile(filename, master.Encode().Bytes(), 0666); nil != e {
+		log.Errorf("Write master playlist '%s' failed:> %s \n", filename, e)
+	} else {
+		log.Infof("Wrote master playlist:> %s \n", filename)
+	}
+}
+
+func (synchron *Synchronizer) findRendition(name string) *Synchronizer {
+	for _, r := range synchron.renditions {
+		if r.name == name {
+			return r.synchron
+		}
+	}
+	return nil
+}
+
+// runLadder runs one Synchronizer per rendition and writes the master playlists pointing to local renditions.
+func (synchron *Synchronizer) runLadder() {
+	synchron.clock = newLadderClock(synchron.option.MaxSegments)
+	if e := synchron.setupLadder(); nil != e {
+		log.Errorf("Setup ladder failed:> %s \n", e)
+		return
+	}
+	if synchron.option.Sync.Enabled {
+		synchron.saveMasterPlaylist(filepath.Join(synchron.option.Sync.Output, synchron.option.Sync.IndexName),
+			synchron.localMaster(func(name string) string {
+				return name + "/" + synchron.option.Sync.IndexName
+			}))
+	}
+	if synchron.option.Record.Enabled && synchron.option.Record.Timeshifting {
+		synchron.saveMasterPlaylist(filepath.Join(synchron.option.Record.Output, synchron.option.Record.TimeshiftFilename),
+			synchron.localMaster(func(name string) string {
+				return name + "/" + filepath.ToSlash(synchron.option.Record.TimeshiftFilename)
+			}))
+	}
+	var wg, services sync.WaitGroup
+	for _, r := range synchron.renditions {
+		if r.synchron == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *Synchronizer) {
+			s.Run()
+			// The ladder stops as a whole when any of its renditions stopped, others drain on shutdown.
+			if !synchron.halted() {
+				synchron.Stop()
+			}
+			wg.Done()
+		}(r.synchron)
+	}
+	if synchron.option.Http.Enabled {
+		services.Add(1)
+		go func() {
+			synchron.HttpServe()
+			services.Done()
+		}()
+	}
+	wg.Wait()
+	synchron.Stop()
+	services.Wait()
+}
@@ -0,0 +1,251 @@
+/**
+This source file contains the Low-Latency HLS ingest: blocking playlist reload, partial segments and preload hints.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/archsh/go.m3u8"
+)
+
+// lowLatency is what a media playlist tells about Low-Latency HLS, which go.m3u8 does not parse.
+type lowLatency struct {
+	url            string // URL of the media playlist, blocking reloads are requested on it.
+	targetDuration float64
+	canBlockReload bool
+	partHoldBack   float64
+	partTarget     float64
+	parts          []*partialSegment
+	hint           *partialSegment // EXT-X-PRELOAD-HINT of the next part.
+	nextMSN        uint64          // Media sequence of the segment in progress.
+}
+
+// partialSegment is an EXT-X-PART of a source.
+type partialSegment struct {
+	msn         uint64 // Media sequence of the parent segment.
+	duration    float64
+	uri         string
+	limit       int64
+	offset      int64
+	independent bool
+	gap         bool
+	file        *partFile
+}
+
+// partFile is a partial segment synced locally, shared by the playlists listing it.
+type partFile struct {
+	name   string
+	gap    bool // Failed to download.
+	listed bool // Listed by source, not only hinted.
+}
+
+// parseAttributes parses an attribute list, quoted values are unquoted.
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				end = len(s) - 1
+			}
+			value = s[1 : end+1]
+			s = s[end+2:]
+		} else if comma := strings.IndexByte(s, ','); comma >= 0 {
+			value = s[:comma]
+			s = s[comma:]
+		} else {
+			value = s
+			s = ""
+		}
+		attrs[name] = strings.TrimSpace(value)
+		s = strings.TrimPrefix(s, ",")
+	}
+	return attrs
+}
+
+// parseByteRange parses 'n[@o]', offset is -1 when absent.
+func parseByteRange(s string) (int64, int64) {
+	parts := strings.SplitN(s, "@", 2)
+	limit, _ := strconv.ParseInt(parts[0], 10, 64)
+	offset := int64(-1)
+	if len(parts) > 1 {
+		offset, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	return limit, offset
+}
+
+// parseLowLatency parses Low-Latency HLS tags of a media playlist, URIs are resolved with base. Nil is returned for
+// playlists without them.
+func parseLowLatency(body []byte, seqNo uint64, base *url.URL) *lowLatency {
+	ll := &lowLatency{nextMSN: seqNo}
+	found := false
+	var last *partialSegment
+	resolve := func(uri string) string {
+		if u, e := base.Parse(uri); nil == e {
+			return u.String()
+		}
+		return uri
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:"):
+			found = true
+			attrs := parseAttributes(line[len("#EXT-X-SERVER-CONTROL:"):])
+			ll.canBlockReload = attrs["CAN-BLOCK-RELOAD"] == "YES"
+			ll.partHoldBack, _ = strconv.ParseFloat(attrs["PART-HOLD-BACK"], 64)
+		case strings.HasPrefix(line, "#EXT-X-PART-INF:"):
+			found = true
+			ll.partTarget, _ = strconv.ParseFloat(parseAttributes(line[len("#EXT-X-PART-INF:"):])["PART-TARGET"], 64)
+		case strings.HasPrefix(line, "#EXT-X-PART:"):
+			attrs := parseAttributes(line[len("#EXT-X-PART:"):])
+			part := &partialSegment{msn: ll.nextMSN, uri: resolve(attrs["URI"])}
+			part.duration, _ = strconv.ParseFloat(attrs["DURATION"], 64)
+			part.independent = attrs["INDEPENDENT"] == "YES"
+			part.gap = attrs["GAP"] == "YES"
+			if v, ok := attrs["BYTERANGE"]; ok {
+				part.limit, part.offset = parseByteRange(v)
+				if part.offset < 0 {
+					// Follows the previous part of the same resource.
+					part.offset = 0
+					if nil != last && last.uri == part.uri {
+						part.offset = last.offset + last.limit
+					}
+				}
+			}
+			ll.parts = append(ll.parts, part)
+			last = part
+		case strings.HasPrefix(line, "#EXT-X-PRELOAD-HINT:"):
+			attrs := parseAttributes(line[len("#EXT-X-PRELOAD-HINT:"):])
+			// Hints of open ended byte ranges can not be fetched as a part.
+			if attrs["TYPE"] == "PART" && attrs["BYTERANGE-START"] == "" {
+				ll.hint = &partialSegment{uri: resolve(attrs["URI"])}
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			ll.nextMSN++
+		}
+	}
+	if !found {
+		return nil
+	}
+	return ll
+}
+
+// key identifies a partial segment across playlist reloads.
+func (part *partialSegment) key() string {
+	if part.limit > 0 {
+		return fmt.Sprintf("%s@%d", part.uri, part.offset)
+	}
+	return part.uri
+}
+
+// partName names a partial segment synced locally by its name on source.
+func (synchron *Synchronizer) partName(part *partialSegment) string {
+	name := part.uri
+	if u, e := url.Parse(part.uri); nil == e {
+		name = path.Base(u.Path)
+	}
+	if part.limit > 0 {
+		name = rangeFilename(name, part.offset)
+	}
+	return synchron.sourceCrc16 + "_" + name
+}
+
+// blockingQuery makes the query of a blocking playlist reload for the next part, or the next segment when the
+// source lists no part.
+func (ll *lowLatency) blockingQuery() string {
+	q := url.Values{}
+	if n := len(ll.parts); n > 0 {
+		last := ll.parts[n-1]
+		index := 0
+		for _, part := range ll.parts {
+			if part.msn == last.msn {
+				index++
+			}
+		}
+		if last.msn < ll.nextMSN {
+			// Parts of the segment in progress are not listed yet.
+			q.Set("_HLS_msn", strconv.FormatUint(ll.nextMSN, 10))
+			q.Set("_HLS_part", "0")
+		} else {
+			q.Set("_HLS_msn", strconv.FormatUint(last.msn, 10))
+			q.Set("_HLS_part", strconv.Itoa(index))
+		}
+	} else {
+		q.Set("_HLS_msn", strconv.FormatUint(ll.nextMSN, 10))
+	}
+	return q.Encode()
+}
+
+// blockingURL adds the query of a blocking playlist reload to urlStr, when it is the media playlist of ll.
+func (ll *lowLatency) blockingURL(urlStr string) (string, bool) {
+	if nil == ll || !ll.canBlockReload || urlStr != ll.url {
+		return urlStr, false
+	}
+	if strings.Contains(urlStr, "?") {
+		return urlStr + "&" + ll.blockingQuery(), true
+	}
+	return urlStr + "?" + ll.blockingQuery(), true
+}
+
+// holdTime is how long a server may hold a blocking playlist reload, three times the target duration.
+func holdTime(targetDuration float64) time.Duration {
+	return time.Duration(targetDuration*3000) * time.Millisecond
+}
+
+// partTag makes the EXT-X-PART line of a partial segment synced locally.
+func partTag(part *partialSegment) string {
+	tag := fmt.Sprintf("#EXT-X-PART:DURATION=%.5f,URI=\"%s\"", part.duration, part.file.name)
+	if part.independent {
+		tag += ",INDEPENDENT=YES"
+	}
+	if part.gap || part.file.gap {
+		tag += ",GAP=YES"
+	}
+	return tag + "\n"
+}
+
+// lowLatencyTags makes EXT-X-SERVER-CONTROL and EXT-X-PART-INF of the synced playlist. Synced files are served
+// statically, so blocking reload is not announced.
+func (ll *lowLatency) lowLatencyTags() string {
+	holdBack := ll.partHoldBack
+	if holdBack < ll.partTarget*3 {
+		holdBack = ll.partTarget * 3
+	}
+	return fmt.Sprintf("#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=%.3f\n#EXT-X-PART-INF:PART-TARGET=%.5f\n", holdBack, ll.partTarget)
+}
+
+// syncedParts returns the listed partial segments synced, nil when republishing is not possible.
+func (ll *lowLatency) syncedParts() []*partialSegment {
+	if nil == ll || ll.partTarget <= 0 {
+		return nil
+	}
+	var parts []*partialSegment
+	for _, part := range ll.parts {
+		if nil != part.file {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// partSegment makes the segment of a partial segment queued for downloading.
+func partSegment(part *partialSegment) *m3u8.MediaSegment {
+	return &m3u8.MediaSegment{URI: part.file.name, Duration: part.duration}
+}
@@ -42,7 +42,7 @@ func InitializeLogging(config *LoggingConfig, useStd bool, level string) {
     } else {
         f, e := os.OpenFile(config.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
         if nil != e {
-            fmt.Errorf("Open file <%s> for logging failed<%v>!\n", config.Filename, e)
+            os.Stderr.Write([]byte(fmt.Sprintf("Open file <%s> for logging failed<%v>!\n", config.Filename, e)))
         } else {
             log.SetOutput(f)
             OUTPUT_FILE = f
@@ -25,13 +25,58 @@ import (
     "flag"
     "fmt"
     "os"
+    "os/signal"
+    "strings"
+    "syscall"
     "time"
+
+    log "github.com/Sirupsen/logrus"
 )
 
 //const VERSION = "0.9.24-dev"
 
 var logging_config = LoggingConfig{Format: DEFAULT_FORMAT, Level: "DEBUG"}
 
+// resolveFlags collects repeated 'host=ip' arguments.
+type resolveFlags map[string]string
+
+func (r resolveFlags) String() string {
+    var entries []string
+    for host, ip := range r {
+        entries = append(entries, host+"="+ip)
+    }
+    return strings.Join(entries, ", ")
+}
+
+func (r resolveFlags) Set(s string) error {
+    kv := strings.SplitN(s, "=", 2)
+    if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+        return fmt.Errorf("invalid resolve '%s', should be like 'host=ip' or 'host:port=ip'", s)
+    }
+    r[kv[0]] = kv[1]
+    return nil
+}
+
+// headerFlags collects repeated 'Name: value' header arguments.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+    var headers []string
+    for name, value := range h {
+        headers = append(headers, name+": "+value)
+    }
+    return strings.Join(headers, ", ")
+}
+
+func (h headerFlags) Set(s string) error {
+    kv := strings.SplitN(s, ":", 2)
+    if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+        return fmt.Errorf("invalid header '%s', should be like 'Name: value'", s)
+    }
+    h[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+    return nil
+}
+
 func Usage() {
     guide := `
 Scenarios:
@@ -74,6 +119,100 @@ func main() {
     flag.StringVar(&option.ProgramTimeFormat, "PF", time.RFC3339Nano, "To fit some stupid encoders which generated stupid time format.")
     //ProgramTimezone string
     flag.StringVar(&option.ProgramTimezone, "PZ", "UTC", "Timezone for PROGRAM-DATE-TIME.")
+    //RestartDelay int
+    flag.IntVar(&option.RestartDelay, "RD", 1, "Initial delay in seconds before restarting a crashed channel.")
+    //RestartMaxDelay int
+    flag.IntVar(&option.RestartMaxDelay, "RX", 60, "Max delay in seconds of restarting a crashed channel.")
+    //StateFile string
+    flag.StringVar(&option.StateFile, "CS", ".hls-sync.state", "Capture state file name in output directory, empty to disable.")
+    //ShutdownTimeout int
+    flag.IntVar(&option.ShutdownTimeout, "QT", 10, "Seconds to deliver segments queued on SIGTERM/SIGINT before stopping at once.")
+    //GapLog string
+    flag.StringVar(&option.GapLog, "GL", "gaps.log", "Gap log file name in output directory, empty to disable.")
+    // Source Arguments ================================================================================================
+    //VariantPolicy string // highest/lowest/resolution/codecs/index
+    flag.StringVar(&option.Source.VariantPolicy, "VP", "highest", "Variant policy for master playlist: highest, lowest, resolution, codecs, index.")
+    //VariantResolution string
+    flag.StringVar(&option.Source.VariantResolution, "VR", "", "Preferred variant resolution when variant policy is 'resolution', eg: 1280x720.")
+    //VariantCodecs string
+    flag.StringVar(&option.Source.VariantCodecs, "VC", "", "Required variant codecs when variant policy is 'codecs', eg: avc1,mp4a.")
+    //VariantIndex int
+    flag.IntVar(&option.Source.VariantIndex, "VI", 0, "Variant index when variant policy is 'index'.")
+    //MasterRefresh int
+    flag.IntVar(&option.Source.MasterRefresh, "MR", 300, "Re-resolve master playlist interval in seconds.")
+    //Ladder bool
+    flag.BoolVar(&option.Source.Ladder, "LD", false, "Ladder mode: follow all variants and renditions of master playlist.")
+    //FailoverScore int
+    flag.IntVar(&option.Source.FailoverScore, "FS", 50, "Switch to the best backup source when health score (0-100) of active source is below it.")
+    //FailbackAfter int
+    flag.IntVar(&option.Source.FailbackAfter, "FB", 60, "Switch back to primary source after it is healthy for seconds, 0 to disable.")
+    //ProbeInterval int
+    flag.IntVar(&option.Source.ProbeInterval, "PI", 10, "Interval in seconds of probing inactive sources, 0 to disable.")
+    //Mode string // failover/redundant
+    flag.StringVar(&option.Source.Mode, "SM", "failover", "Source mode: failover, redundant (poll all sources and fill missing segments from others).")
+    //AlignBy string // program/sequence
+    flag.StringVar(&option.Source.AlignBy, "AB", "program", "Align segments of redundant sources by: program (PROGRAM-DATE-TIME), sequence (media sequence).")
+    //DedupBy string // sequence/path/uri
+    flag.StringVar(&option.Source.DedupBy, "DB", "sequence", "Tell segments apart by: sequence (media and discontinuity sequence), path (URI without host and query), uri.")
+    // Source Authentication Arguments ================================================================================
+    auth := &SourceAuth{Headers: headerFlags{}}
+    //Headers map[string]string
+    flag.Var(headerFlags(auth.Headers), "AH", "Extra request header to sources like 'Referer: http://example.com/', can be repeated.")
+    //Username string
+    flag.StringVar(&auth.Username, "AU", "", "Username of basic authentication to sources.")
+    //Password string
+    flag.StringVar(&auth.Password, "AP", "", "Password of basic authentication, 'env:NAME' or 'file:PATH' to load it from environment or file.")
+    //BearerToken string
+    flag.StringVar(&auth.BearerToken, "AT", "", "Bearer token to sources, 'env:NAME' or 'file:PATH' to load it from environment or file.")
+    //Cookies bool
+    flag.BoolVar(&auth.Cookies, "AC", false, "Keep cookies set by sources and send them back.")
+    //TokenParams []string
+    var tokenParams string
+    flag.StringVar(&tokenParams, "AQ", "", "Query parameters of playlist URL propagated to segment and key URLs, separated by comma, eg: token,expires.")
+    //Resolver string
+    flag.StringVar(&option.Source.Resolver, "RV", "", "Command or local http(s) endpoint returning fresh source URLs, called at start, on HTTP 401/403 and before expiry.")
+    //ExpiryParam string
+    flag.StringVar(&option.Source.ExpiryParam, "EP", "", "Query parameter of source URLs holding the unix time their signature expires, eg: expires.")
+    // Source Network Arguments =======================================================================================
+    network := &SourceNetwork{Resolve: resolveFlags{}}
+    //Proxy string
+    flag.StringVar(&network.Proxy, "NP", "", "Proxy to sources: http://, https:// or socks5://. Default empty means by environment.")
+    //CAFile string
+    flag.StringVar(&network.CAFile, "NC", "", "Extra CA certificates file in PEM to verify sources.")
+    //CertFile string
+    flag.StringVar(&network.CertFile, "NT", "", "Client certificate file in PEM for mutual TLS.")
+    //KeyFile string
+    flag.StringVar(&network.KeyFile, "NK", "", "Client key file in PEM for mutual TLS.")
+    //Insecure bool
+    flag.BoolVar(&network.Insecure, "NI", false, "Skip verifying certificates of sources.")
+    //LocalAddr string
+    flag.StringVar(&network.LocalAddr, "NB", "", "Local IP address or network interface to bind.")
+    //Resolve map[string]string
+    flag.Var(resolveFlags(network.Resolve), "NR", "Resolve host to IP address like 'host=ip' or 'host:port=ip', can be repeated.")
+    // Download Arguments ==============================================================================================
+    //Workers int
+    flag.IntVar(&option.Download.Workers, "DW", 4, "Max segments downloading in parallel.")
+    //PerHost int
+    flag.IntVar(&option.Download.PerHost, "DH", 4, "Max segments downloading in parallel from the same host.")
+    //RateLimit int
+    flag.IntVar(&option.Download.RateLimit, "DR", 0, "Max download rate of segments in kbit/s, 0 for unlimited.")
+    //GlobalRateLimit int
+    flag.IntVar(&option.Download.GlobalRateLimit, "DG", 0, "Max download rate of segments in kbit/s shared by all channels, 0 for unlimited.")
+    //CatchUp int
+    flag.IntVar(&option.Download.CatchUp, "DC", 0, "Spread downloads of segments behind live edge over seconds, 0 to download at once.")
+    //CheckDuration bool
+    flag.BoolVar(&option.Download.CheckDuration, "DD", false, "Check PTS span of TS segments matches their duration.")
+    //Backfill int
+    flag.IntVar(&option.Download.Backfill, "DF", 10, "Max segments missing in a gap to backfill from backup sources or by derived URIs, 0 to disable.")
+    // Encrypt Arguments ===============================================================================================
+    //Method string // AES-128/SAMPLE-AES
+    flag.StringVar(&option.Encrypt.Method, "EM", "", "Encrypt synced and recorded segments: AES-128, SAMPLE-AES. Default empty means no encryption.")
+    //KeyDir string
+    flag.StringVar(&option.Encrypt.KeyDir, "EK", "", "Key directory. Default 'keys' in record output, or sync output when recording is disabled.")
+    //KeyUri string
+    flag.StringVar(&option.Encrypt.KeyUri, "EU", "", "URI prefix of keys in playlists. Default empty means relative paths to key files.")
+    //RotateEvery int
+    flag.IntVar(&option.Encrypt.RotateEvery, "ER", 10, "Rotate key every N segments, 0 means one key for each run.")
     // Sync Arguments ==================================================================================================
     //Enabled bool
     flag.BoolVar(&option.Sync.Enabled, "S", false, "Sync enabled.")
@@ -82,11 +221,17 @@ func main() {
     //IndexName string
     flag.StringVar(&option.Sync.IndexName, "OI", "live.m3u8", "Index playlist filename.")
     //ReSegment bool
-    flag.BoolVar(&option.Sync.ReSegment, "RS", false, "ReSegment enabled.")
+    flag.BoolVar(&option.Sync.ReSegment, "RS", false, "ReSegment enabled, TS segments are re-cut at key frames.")
+    //ReSegmentDuration int
+    flag.IntVar(&option.Sync.ReSegmentDuration, "RT", 0, "Target duration of segments re-cut in seconds, 0 means the target duration of source.")
     //RemoveOld bool
     flag.BoolVar(&option.Sync.RemoveOld, "RM", false, "Remove old segments.")
     //CleanFolder bool
     flag.BoolVar(&option.Sync.CleanFolder, "CF", false, "Clean target output folder.")
+    //KeepEncrypted bool
+    flag.BoolVar(&option.Sync.KeepEncrypted, "KE", false, "Keep segments of encrypted sources encrypted when syncing.")
+    //LowLatency bool
+    flag.BoolVar(&option.Sync.LowLatency, "SL", false, "Republish synced playlist as Low-Latency HLS with partial segments.")
     // Record Arguments ================================================================================================
     //Enabled bool
     flag.BoolVar(&option.Record.Enabled, "RC", false, "Record enabled.")
@@ -121,6 +266,18 @@ func main() {
     flag.IntVar(&option.Http.CacheNum, "CN", 128, "Num of Cache entries for avoid re-generating playlist.")
     // CacheValid int
     flag.IntVar(&option.Http.CacheValid, "CV", 60, "Cache valid duration in seconds.")
+    // Alert Arguments =================================================================================================
+    //Webhooks []string
+    var webhooks string
+    flag.StringVar(&webhooks, "WH", "", "Webhook URLs alerts are posted to in JSON, separated by comma. Default empty means no alerting.")
+    //Stall int
+    flag.IntVar(&option.Alert.Stall, "WS", 30, "Alert when no new segment arrives for seconds, 0 to disable.")
+    //Failures int
+    flag.IntVar(&option.Alert.Failures, "WF", 3, "Alert after segments failed to download in a row, 0 to disable.")
+    //Dedup int
+    flag.IntVar(&option.Alert.Dedup, "WD", 300, "Seconds an alert of the same channel and condition is not repeated.")
+    //Rate int
+    flag.IntVar(&option.Alert.Rate, "WR", 10, "Max alerts per minute shared by all channels, 0 for unlimited.")
     // Functional Arguments ============================================================================================
     var config string
     flag.StringVar(&config, "c", "", "Configuration file instead of command line parameters. Default empty means using parameters.")
@@ -129,6 +286,18 @@ func main() {
     var showVersion bool
     flag.BoolVar(&showVersion, "v", false, "Display version info.")
     flag.Parse()
+    if tokenParams != "" {
+        auth.TokenParams = strings.Split(tokenParams, ",")
+    }
+    if webhooks != "" {
+        option.Alert.Webhooks = strings.Split(webhooks, ",")
+    }
+    if len(auth.Headers) > 0 || auth.Username != "" || auth.BearerToken != "" || auth.Cookies || len(auth.TokenParams) > 0 {
+        option.Source.Auth = []*SourceAuth{auth}
+    }
+    if network.Proxy != "" || network.CAFile != "" || network.CertFile != "" || network.Insecure || network.LocalAddr != "" || len(network.Resolve) > 0 {
+        option.Source.Network = []*SourceNetwork{network}
+    }
 
     if showVersion {
         os.Stderr.Write([]byte(fmt.Sprintf("hls-sync %v (%s) Built @ %s \n", VERSION, TAG, BUILD_TIME)))
@@ -136,16 +305,15 @@ func main() {
     }
     os.Stderr.Write([]byte(fmt.Sprintf("hls-sync %v (%s)- HTTP Live Streaming (HLS) Synchronizer.\n", VERSION, TAG)))
     os.Stderr.Write([]byte("Copyright (C) 2015 Mingcai SHEN <archsh@gmail.com>. Licensed for use under the GNU GPL version 3.\n"))
+    // Options by command line, which configuration file is reloaded over.
+    base := option
     if config != "" {
-        if e := LoadConfiguration(config, &option); e != nil {
+        if e := loadConfig(config, &option); e != nil {
             os.Stderr.Write([]byte(fmt.Sprintf("Load config<%s> failed: %s.\n", config, e)))
             os.Exit(1)
         } else {
             os.Stderr.Write([]byte(fmt.Sprintf("Loaded config from <%s>.\n", config)))
         }
-        if flag.NArg() > 0 {
-            option.Source.Urls = append(option.Source.Urls, flag.Args()...)
-        }
     } else {
         if flag.NArg() < 1 && !check {
             os.Stderr.Write([]byte("\n\n!!! At least one source URL is required!\n"))
@@ -159,12 +327,7 @@ func main() {
         CheckConfiguration(&option, os.Stderr)
         os.Exit(0)
     }
-    if option.Retries < 1 {
-        option.Retries = 1
-    }
-    if option.ProgramTimeFormat == "" {
-        option.ProgramTimeFormat = time.RFC3339Nano
-    }
+    fixOption(&option)
 
     logging_config.Filename = option.LogFile
     logging_config.Level = option.LogLevel
@@ -175,10 +338,102 @@ func main() {
     }
     defer DeinitializeLogging()
 
-    if sync, e := NewSynchronizer(&option); e != nil {
+    if len(option.Channels) > 0 {
+        if supervisor, e := NewSupervisor(&option); e != nil {
+            os.Stderr.Write([]byte(fmt.Sprintf("Start failed: %s.\n", e)))
+            os.Exit(1)
+        } else {
+            handleSignals(supervisor, time.Duration(option.ShutdownTimeout)*time.Second, config, base)
+            supervisor.Run()
+        }
+    } else if sync, e := NewSynchronizer(&option); e != nil {
         os.Stderr.Write([]byte(fmt.Sprintf("Start failed: %s.\n", e)))
         os.Exit(1)
     } else {
+        handleSignals(sync, time.Duration(option.ShutdownTimeout)*time.Second, config, base)
         sync.Run()
     }
 }
+
+// loadConfig loads configuration file over option, source URLs in arguments are appended.
+func loadConfig(config string, option *Option) error {
+    if e := LoadConfiguration(config, option); e != nil {
+        return e
+    }
+    if flag.NArg() > 0 {
+        option.Source.Urls = append(option.Source.Urls, flag.Args()...)
+    }
+    return nil
+}
+
+// fixOption sets defaults of options which are invalid.
+func fixOption(option *Option) {
+    if option.Retries < 1 {
+        option.Retries = 1
+    }
+    if option.ProgramTimeFormat == "" {
+        option.ProgramTimeFormat = time.RFC3339Nano
+    }
+    for _, channel := range option.Channels {
+        if channel.Retries < 1 {
+            channel.Retries = 1
+        }
+        if channel.ProgramTimeFormat == "" {
+            channel.ProgramTimeFormat = time.RFC3339Nano
+        }
+    }
+}
+
+// runnable is a Synchronizer or a Supervisor.
+type runnable interface {
+    Shutdown(timeout time.Duration)
+    Reload(option *Option) ([]string, error)
+}
+
+// handleSignals shuts down on SIGTERM or SIGINT, and exits at once on the second one. Configuration file is reloaded
+// over options by command line on SIGHUP.
+func handleSignals(runner runnable, timeout time.Duration, config string, base Option) {
+    signals := make(chan os.Signal, 2)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+    go func() {
+        for sig := range signals {
+            if sig == syscall.SIGHUP {
+                reloadConfig(runner, config, base)
+                continue
+            }
+            log.Infof("Received %s, shutting down in %s ...\n", sig, timeout)
+            runner.Shutdown(timeout)
+            break
+        }
+        for sig := range signals {
+            if sig != syscall.SIGHUP {
+                log.Errorf("Received %s again, exiting at once.\n", sig)
+                os.Exit(1)
+            }
+        }
+    }()
+}
+
+// reloadConfig reloads configuration file, and applies it when it is valid.
+func reloadConfig(runner runnable, config string, base Option) {
+    if config == "" {
+        log.Warningln("Received SIGHUP, but no configuration file to reload.")
+        return
+    }
+    log.Infof("Received SIGHUP, reloading config<%s> ...\n", config)
+    option := base
+    if e := loadConfig(config, &option); e != nil {
+        log.Errorf("Reload config<%s> failed, nothing changed:> %s \n", config, e)
+        return
+    }
+    fixOption(&option)
+    restart, e := runner.Reload(&option)
+    if e != nil {
+        log.Errorf("Reload config<%s> failed, nothing changed:> %s \n", config, e)
+        return
+    }
+    log.Infof("Reloaded config from <%s>.\n", config)
+    if len(restart) > 0 {
+        log.Warningf("Changed options require a restart to take effect:> %s \n", strings.Join(restart, ", "))
+    }
+}
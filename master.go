@@ -0,0 +1,136 @@
+/**
+This source file contains the master playlist variant selection.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/archsh/go.m3u8"
+)
+
+type VariantPolicy uint8
+
+const (
+	VP_HIGHEST VariantPolicy = 1 + iota
+	VP_LOWEST
+	VP_RESOLUTION
+	VP_CODECS
+	VP_INDEX
+)
+
+// resolvedVariant remembers which variant of a master playlist is followed.
+type resolvedVariant struct {
+	url      string
+	resolved time.Time
+	params   m3u8.VariantParams
+}
+
+func parseVariantPolicy(s string) (VariantPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "highest":
+		return VP_HIGHEST, nil
+	case "lowest":
+		return VP_LOWEST, nil
+	case "resolution":
+		return VP_RESOLUTION, nil
+	case "codecs":
+		return VP_CODECS, nil
+	case "index":
+		return VP_INDEX, nil
+	}
+	return 0, fmt.Errorf("unknown variant policy '%s'", s)
+}
+
+// parseResolution parses 'WIDTHxHEIGHT' into pixels.
+func parseResolution(s string) (int, int, bool) {
+	ss := strings.SplitN(strings.ToLower(strings.TrimSpace(s)), "x", 2)
+	if len(ss) != 2 {
+		return 0, 0, false
+	}
+	w, e1 := strconv.Atoi(ss[0])
+	h, e2 := strconv.Atoi(ss[1])
+	if e1 != nil || e2 != nil {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+// selectVariant picks one of the (non I-frame) variants of a master playlist according to source options.
+func selectVariant(master *m3u8.MasterPlaylist, option *SourceOption) (*m3u8.Variant, error) {
+	var variants []*m3u8.Variant
+	for _, v := range master.Variants {
+		if v != nil && !v.Iframe && v.URI != "" {
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) < 1 {
+		return nil, errors.New("no variant in master playlist")
+	}
+	policy, e := parseVariantPolicy(option.VariantPolicy)
+	if e != nil {
+		return nil, e
+	}
+	var selected *m3u8.Variant
+	switch policy {
+	case VP_LOWEST:
+		for _, v := range variants {
+			if selected == nil || v.Bandwidth < selected.Bandwidth {
+				selected = v
+			}
+		}
+	case VP_RESOLUTION:
+		w, h, ok := parseResolution(option.VariantResolution)
+		if !ok {
+			return nil, fmt.Errorf("invalid variant resolution '%s'", option.VariantResolution)
+		}
+		best := -1
+		for _, v := range variants {
+			vw, vh, ok := parseResolution(v.Resolution)
+			if !ok {
+				continue
+			}
+			diff := (vw-w)*(vw-w) + (vh-h)*(vh-h)
+			if best < 0 || diff < best || (diff == best && v.Bandwidth > selected.Bandwidth) {
+				best = diff
+				selected = v
+			}
+		}
+		if selected == nil {
+			return nil, errors.New("no variant with RESOLUTION in master playlist")
+		}
+	case VP_CODECS:
+		want := strings.Split(option.VariantCodecs, ",")
+		for _, v := range variants {
+			matched := true
+			for _, c := range want {
+				if c = strings.TrimSpace(c); c != "" && !strings.Contains(v.Codecs, c) {
+					matched = false
+					break
+				}
+			}
+			if matched && (selected == nil || v.Bandwidth > selected.Bandwidth) {
+				selected = v
+			}
+		}
+		if selected == nil {
+			return nil, fmt.Errorf("no variant matches CODECS '%s'", option.VariantCodecs)
+		}
+	case VP_INDEX:
+		if option.VariantIndex < 0 || option.VariantIndex >= len(variants) {
+			return nil, fmt.Errorf("variant index %d out of range [0, %d)", option.VariantIndex, len(variants))
+		}
+		selected = variants[option.VariantIndex]
+	default:
+		for _, v := range variants {
+			if selected == nil || v.Bandwidth > selected.Bandwidth {
+				selected = v
+			}
+		}
+	}
+	return selected, nil
+}
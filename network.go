@@ -0,0 +1,164 @@
+/**
+This source file contains the outbound network of sources: proxies, TLS certificates, local address binding and
+static resolving of hosts.
+*/
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// networkRoute is the transport of URLs starting with prefix.
+type networkRoute struct {
+	prefix    string
+	transport *http.Transport
+}
+
+// networkTransport sends requests by the transport of the longest prefix matching their URL.
+type networkTransport struct {
+	routes   []*networkRoute
+	fallback http.RoundTripper
+}
+
+func (t *networkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var found *networkRoute
+	s := req.URL.String()
+	for _, route := range t.routes {
+		if strings.HasPrefix(s, route.prefix) && (nil == found || len(route.prefix) > len(found.prefix)) {
+			found = route
+		}
+	}
+	if nil == found {
+		return t.fallback.RoundTrip(req)
+	}
+	return found.transport.RoundTrip(req)
+}
+
+// setupNetwork sets the transport of client when network of sources is configured.
+func (synchron *Synchronizer) setupNetwork() error {
+	if len(synchron.option.Source.Network) < 1 {
+		return nil
+	}
+	t := &networkTransport{fallback: http.DefaultTransport}
+	for i, option := range synchron.option.Source.Network {
+		transport, e := newTransport(option)
+		if nil != e {
+			return fmt.Errorf("source network #%d: %s", i, e)
+		}
+		t.routes = append(t.routes, &networkRoute{prefix: option.Prefix, transport: transport})
+	}
+	synchron.client.Transport = t
+	return nil
+}
+
+func newTransport(option *SourceNetwork) (*http.Transport, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: option.Insecure},
+	}
+	if option.Proxy != "" {
+		// http, https and socks5 proxies are supported by transport.
+		proxy, e := url.Parse(option.Proxy)
+		if nil != e {
+			return nil, fmt.Errorf("proxy: %s", e)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if option.CAFile != "" {
+		pool, e := x509.SystemCertPool()
+		if nil != e {
+			pool = x509.NewCertPool()
+		}
+		pem, e := ioutil.ReadFile(option.CAFile)
+		if nil != e {
+			return nil, fmt.Errorf("CA file: %s", e)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA file: no certificate found in '%s'", option.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if option.CertFile != "" {
+		cert, e := tls.LoadX509KeyPair(option.CertFile, option.KeyFile)
+		if nil != e {
+			return nil, fmt.Errorf("client certificate: %s", e)
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	if option.LocalAddr != "" {
+		ip, e := localIP(option.LocalAddr)
+		if nil != e {
+			return nil, fmt.Errorf("local address: %s", e)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	resolve := option.Resolve
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, resolveAddr(resolve, addr))
+	}
+	return transport, nil
+}
+
+// localIP returns the IP address to bind, addr is an IP address or the name of a network interface.
+func localIP(addr string) (net.IP, error) {
+	if ip := net.ParseIP(addr); nil != ip {
+		return ip, nil
+	}
+	iface, e := net.InterfaceByName(addr)
+	if nil != e {
+		return nil, e
+	}
+	addrs, e := iface.Addrs()
+	if nil != e {
+		return nil, e
+	}
+	var found net.IP
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			// IPv4 address is preferred.
+			if ipnet.IP.To4() != nil {
+				return ipnet.IP, nil
+			} else if nil == found {
+				found = ipnet.IP
+			}
+		}
+	}
+	if nil == found {
+		return nil, errors.New("no address on interface " + addr)
+	}
+	return found, nil
+}
+
+// resolveAddr replaces the host of addr by the IP address it maps to in resolve, by 'host:port' or 'host'.
+func resolveAddr(resolve map[string]string, addr string) string {
+	if len(resolve) < 1 {
+		return addr
+	}
+	if ip, ok := resolve[addr]; ok {
+		_, port, _ := net.SplitHostPort(addr)
+		return net.JoinHostPort(ip, port)
+	}
+	host, port, e := net.SplitHostPort(addr)
+	if nil != e {
+		return addr
+	}
+	if ip, ok := resolve[host]; ok {
+		return net.JoinHostPort(ip, port)
+	}
+	return addr
+}
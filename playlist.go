@@ -0,0 +1,224 @@
+/**
+This source file contains the encoding helpers of media playlists written by sync, record and HTTP service.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/archsh/go.m3u8"
+)
+
+const discontinuitySequenceTag = "#EXT-X-DISCONTINUITY-SEQUENCE:"
+
+// encodePlaylist encodes a media playlist with its discontinuity sequence. Segments may carry the key they are
+// encrypted with and the initialization section they need, EXT-X-KEY and EXT-X-MAP are only written when changed.
+// Partial segments synced of ll are written when it is not nil, segments in gaps are marked by EXT-X-GAP.
+func encodePlaylist(mpl *m3u8.MediaPlaylist, discontinuitySeq uint64, ll *lowLatency, gaps map[string]bool) *bytes.Buffer {
+	// go.m3u8 writes EXT-X-MAP of playlist only, those of segments are written before their EXTINF.
+	segments := segmentsInOrder(mpl)
+	parts := ll.syncedParts()
+	for _, v := range segments {
+		if nil != v.Map && mpl.Version() < 6 {
+			mpl.SetVersion(6)
+		}
+		if gaps[v.URI] && mpl.Version() < 8 {
+			mpl.SetVersion(8)
+		}
+	}
+	out := &bytes.Buffer{}
+	lastKey := ""
+	lastMap := ""
+	for _, line := range strings.SplitAfter(mpl.Encode().String(), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-KEY:") {
+			if line == lastKey {
+				continue
+			}
+			lastKey = line
+		}
+		if strings.HasPrefix(line, "#EXTINF:") && len(segments) > 0 {
+			v := segments[0]
+			if nil != v.Map {
+				if tag := mapTag(v.Map); tag != lastMap {
+					out.WriteString(tag)
+					lastMap = tag
+				}
+			}
+			// Partial segments are listed before their parent segment.
+			for len(parts) > 0 && parts[0].msn <= v.SeqId {
+				if parts[0].msn == v.SeqId {
+					out.WriteString(partTag(parts[0]))
+				}
+				parts = parts[1:]
+			}
+			if gaps[v.URI] {
+				out.WriteString("#EXT-X-GAP\n")
+			}
+			segments = segments[1:]
+		}
+		out.WriteString(line)
+		if discontinuitySeq > 0 && strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") {
+			out.WriteString(discontinuitySequenceTag + strconv.FormatUint(discontinuitySeq, 10) + "\n")
+		}
+		if nil != ll.syncedParts() && strings.HasPrefix(line, "#EXT-X-TARGETDURATION:") {
+			out.WriteString(ll.lowLatencyTags())
+		}
+	}
+	// Partial segments of the segment in progress.
+	for _, part := range parts {
+		out.WriteString(partTag(part))
+	}
+	return out
+}
+
+// stripDiscontinuitySequence removes EXT-X-DISCONTINUITY-SEQUENCE from a playlist and returns its value,
+// go.m3u8 would take it as EXT-X-DISCONTINUITY.
+func stripDiscontinuitySequence(data []byte) ([]byte, uint64) {
+	i := bytes.Index(data, []byte(discontinuitySequenceTag))
+	if i < 0 {
+		return data, 0
+	}
+	end := bytes.IndexByte(data[i:], '\n')
+	if end < 0 {
+		end = len(data)
+	} else {
+		end += i + 1
+	}
+	seq, _ := strconv.ParseUint(strings.TrimSpace(string(data[i+len(discontinuitySequenceTag):end])), 10, 64)
+	return append(append([]byte(nil), data[:i]...), data[end:]...), seq
+}
+
+// readMediaPlaylist reads a media playlist written before, returns it with its discontinuity sequence.
+func (synchron *Synchronizer) readMediaPlaylist(fname string) (*m3u8.MediaPlaylist, uint64, error) {
+	data, e := ioutil.ReadFile(fname)
+	if nil != e {
+		return nil, 0, e
+	}
+	data, seq := stripDiscontinuitySequence(data)
+	playlist, listType, e := m3u8.Decode(*bytes.NewBuffer(data), true, "", synchron.program_timezone)
+	if nil != e {
+		return nil, 0, e
+	}
+	if listType != m3u8.MEDIA {
+		return nil, 0, errors.New("not a media playlist")
+	}
+	mpl := playlist.(*m3u8.MediaPlaylist)
+	fillKeys(mpl)
+	return mpl, seq, nil
+}
+
+// mapTag makes the EXT-X-MAP line of an initialization section.
+func mapTag(m *m3u8.Map) string {
+	if m.Limit > 0 {
+		return fmt.Sprintf("#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@%d\"\n", m.URI, m.Limit, m.Offset)
+	}
+	return fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"\n", m.URI)
+}
+
+// fillKeys sets the key and initialization section of every segment of a decoded playlist, which only sets them on
+// the segment after EXT-X-KEY or EXT-X-MAP.
+func fillKeys(mpl *m3u8.MediaPlaylist) {
+	var key *m3u8.Key
+	var xmap *m3u8.Map
+	for _, v := range mpl.Segments {
+		if nil == v {
+			continue
+		}
+		if nil != v.Key {
+			key = v.Key
+		} else {
+			v.Key = key
+		}
+		if nil != v.Map {
+			xmap = v.Map
+		} else {
+			v.Map = xmap
+		}
+	}
+	mpl.Key = nil
+	mpl.Map = nil
+}
+
+// decodedSegments returns the segments of a decoded playlist, which are kept from the start of Segments, all of them
+// regardless of the window size.
+func decodedSegments(mpl *m3u8.MediaPlaylist) []*m3u8.MediaSegment {
+	var segments []*m3u8.MediaSegment
+	for _, v := range mpl.Segments {
+		if nil != v {
+			segments = append(segments, v)
+		}
+	}
+	return segments
+}
+
+// rangeOffsets fills the offsets of byte ranges declared without one, go.m3u8 takes them as 0 while they follow the
+// previous range of the same resource. All of them are filled before any segment is queued, which renames it.
+func rangeOffsets(mpl *m3u8.MediaPlaylist) {
+	var last *m3u8.MediaSegment
+	for _, v := range mpl.Segments {
+		if nil == v {
+			continue
+		}
+		if v.Limit > 0 && v.Offset == 0 && nil != last && last.Limit > 0 && last.URI == v.URI {
+			v.Offset = last.Offset + last.Limit
+		}
+		last = v
+	}
+}
+
+// segmentsInOrder returns the segments of a playlist in the order they are encoded. go.m3u8 keeps them in a ring
+// buffer without exporting its head, which is found by where a segment appended goes.
+func segmentsInOrder(mpl *m3u8.MediaPlaylist) []*m3u8.MediaSegment {
+	capacity := len(mpl.Segments)
+	total := int(mpl.Count())
+	if capacity == 0 || total == 0 {
+		return nil
+	}
+	head := (ringTail(mpl) - total + capacity) % capacity
+	count := total
+	if winsize := int(mpl.WinSize()); winsize > 0 && winsize < count {
+		count = winsize
+	}
+	segments := make([]*m3u8.MediaSegment, 0, count)
+	for i := 0; i < total && len(segments) < count; i++ {
+		if v := mpl.Segments[(head+i)%capacity]; nil != v {
+			segments = append(segments, v)
+		}
+	}
+	return segments
+}
+
+// ringTail returns the slot of Segments the next segment appended to playlist goes to, by appending a marker to a
+// copy of playlist with segments of its own.
+func ringTail(mpl *m3u8.MediaPlaylist) int {
+	probe := *mpl
+	probe.Segments = make([]*m3u8.MediaSegment, len(mpl.Segments))
+	if probe.Count() >= uint(len(probe.Segments)) {
+		// Full, the slot of the first segment is taken next.
+		probe.Remove()
+	}
+	marker := &m3u8.MediaSegment{}
+	probe.AppendSegment(marker)
+	for i, v := range probe.Segments {
+		if v == marker {
+			return i
+		}
+	}
+	return 0
+}
+
+// isGap tells whether a segment starting at next does not continue the segment prev, within half a segment.
+func isGap(prev *m3u8.MediaSegment, next time.Time) bool {
+	end := prev.ProgramDateTime.Add(time.Duration(prev.Duration*1000) * time.Millisecond)
+	tolerance := time.Duration(prev.Duration*500) * time.Millisecond
+	if tolerance < time.Second {
+		tolerance = time.Second
+	}
+	return next.Sub(end) > tolerance || end.Sub(next) > tolerance
+}
@@ -0,0 +1,161 @@
+/**
+This source file contains the bandwidth limiting of segment downloads and the pacing of catching up.
+*/
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket of bytes, refilled at rate and holding a second of it at most.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64 // Bytes per second.
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter makes a limiter of kbps kilobits per second, nil when it is 0 for unlimited.
+func newRateLimiter(kbps int) *rateLimiter {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1000 / 8
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take takes n bytes from the bucket, returns how long to wait before they are available.
+func (l *rateLimiter) take(n int) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	// Tokens go negative for readers waiting, so they are served in turn.
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Download rate limit shared by all channels in the process, set by the first channel having it.
+var globalLimiter = struct {
+	sync.Mutex
+	limiter *rateLimiter
+}{}
+
+func sharedLimiter(kbps int) *rateLimiter {
+	globalLimiter.Lock()
+	defer globalLimiter.Unlock()
+	if nil == globalLimiter.limiter {
+		globalLimiter.limiter = newRateLimiter(kbps)
+	}
+	return globalLimiter.limiter
+}
+
+// limitedReader reads at the rate of all its limiters.
+type limitedReader struct {
+	reader   io.Reader
+	limiters []*rateLimiter
+	quit     chan struct{}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// Small reads keep the rate smooth.
+	if len(p) > 16*1024 {
+		p = p[:16*1024]
+	}
+	n, e := r.reader.Read(p)
+	var wait time.Duration
+	for _, l := range r.limiters {
+		if d := l.take(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.quit:
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	return n, e
+}
+
+// limitReader limits reading of a segment download by the rate limits of channel and process.
+func (synchron *Synchronizer) limitReader(reader io.Reader) io.Reader {
+	var limiters []*rateLimiter
+	if nil != synchron.limiter {
+		limiters = append(limiters, synchron.limiter)
+	}
+	if l := sharedLimiter(synchron.option.Download.GlobalRateLimit); nil != l {
+		limiters = append(limiters, l)
+	}
+	if len(limiters) < 1 {
+		return reader
+	}
+	return &limitedReader{reader: reader, limiters: limiters, quit: synchron.quit}
+}
+
+// Pacing is armed when more segments than this are behind live edge, fewer ones arrive in a reload as jitter.
+const catchUpThreshold = 2
+
+// catchUpPacer spreads downloads of segments behind live edge over the catch up interval, instead of bursting.
+type catchUpPacer struct {
+	interval time.Duration // Catch up interval, 0 to disable pacing.
+	deadline time.Time     // Pacing ends, converged to live edge.
+	step     time.Duration // Between starts of downloads.
+	next     time.Time
+}
+
+// pace returns how long to wait before downloading a segment with behind more segments after it in the same
+// playlist. Segments arriving at live edge meanwhile are counted in, so the downloads converge to live edge at the
+// end of interval.
+func (pacer *catchUpPacer) pace(behind int, targetDuration float64) time.Duration {
+	if pacer.interval <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if behind > catchUpThreshold && now.After(pacer.deadline) {
+		live := 0
+		if targetDuration > 0 {
+			live = int(pacer.interval.Seconds() / targetDuration)
+		}
+		pacer.deadline = now.Add(pacer.interval)
+		pacer.step = pacer.interval / time.Duration(behind+1+live)
+		pacer.next = now
+	}
+	if now.After(pacer.deadline) {
+		return 0
+	}
+	if pacer.next.Before(now) {
+		pacer.next = now
+	}
+	d := pacer.next.Sub(now)
+	pacer.next = pacer.next.Add(pacer.step)
+	return d
+}
+
+// startPaced starts downloading a segment after delay, in background so messages queued after it are not held
+// back. Pacing ends on shutdown, segments queued are downloaded at once. Returns false if the synchronizer is stopped.
+func (synchron *Synchronizer) startPaced(job *segmentJob, delay time.Duration) bool {
+	if delay <= 0 {
+		return synchron.startDownload(job)
+	}
+	go synchron.guard("segmentPacing", func() {
+		select {
+		case <-time.After(delay):
+		case <-synchron.halt:
+		case <-synchron.quit:
+			return
+		}
+		synchron.startDownload(job)
+	})
+	return true
+}
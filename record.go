@@ -21,6 +21,8 @@ type RecordMessage struct {
     _target_duration float64
     segment          *m3u8.MediaSegment
     seg_buffer       *bytes.Buffer
+    key              *localKey
+    init_buffer      *bytes.Buffer // Initialization section of segment when changed.
 }
 
 type TimeStampType uint8
@@ -53,8 +55,14 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
     var e error
     last_seg_timestamp := time.Time{}
     var last_seg_duration time.Duration = 0
+    var last_seg *m3u8.MediaSegment
+    var timeshift_dseq uint64 = 0
+    // Initialization section of fMP4 segments recorded last.
+    init_file := ""
     _target_duration := 0
     var max_timeshift_segs uint = 0
+    // Position of recorder before restart.
+    restored := synchron.state.recordPosition()
     for msg := range msgChan {
         if nil == msg {
             continue
@@ -70,7 +78,7 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
         if synchron.option.Record.Timeshifting {
             if timeshift_playlist == nil {
                 fname := filepath.Join(synchron.option.Record.Output, synchron.option.Record.TimeshiftFilename)
-                max_timeshift_segs = uint((time.Duration(synchron.option.Record.TimeshiftDuration) * time.Hour) / (time.Second * time.Duration(_target_duration)))
+                max_timeshift_segs = synchron.timeshiftSegments(_target_duration)
                 if ! exists(fname) {
                     timeshift_playlist, e = m3u8.NewMediaPlaylist(max_timeshift_segs, max_timeshift_segs)
                     if e != nil {
@@ -78,24 +86,15 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
                     }
                 } else {
                     // READ playlist.
-                    if f, e := os.Open(fname); e != nil {
+                    if timeshift_playlist, timeshift_dseq, e = synchron.readMediaPlaylist(fname); e != nil {
                         log.Errorf("Read timeshift playlist '%s' failed:> %s \n", fname, e)
                     } else {
-                        if playlist, listType, err := m3u8.DecodeFrom(f, true,"", synchron.program_timezone); nil != err {
-                            log.Errorln("Decode previous index playlist '%s' failed:> %s\n", fname, err)
-                        } else {
-                            if listType == m3u8.MEDIA {
-                                timeshift_playlist = playlist.(*m3u8.MediaPlaylist)
-                                for _, v := range timeshift_playlist.Segments {
-                                    if v != nil {
-                                        last_seg_timestamp = v.ProgramDateTime
-                                    }
-                                }
-                            } else {
-                                log.Warningf("Previous timeshift playlist file '%s' is not a MediaPlaylist ???\n", fname)
+                        for _, v := range timeshift_playlist.Segments {
+                            if v != nil {
+                                last_seg_timestamp = v.ProgramDateTime
+                                last_seg = v
                             }
                         }
-                        f.Close()
                     }
                 }
                 log.Debugf("Set Timeshift playlist winsize to : %d \n", max_timeshift_segs)
@@ -106,6 +105,11 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
                 if e = timeshift_playlist.SetWinSize(max_timeshift_segs); nil != e {
                     log.Errorf("SetWinSize to %d failed:> %s\n", max_timeshift_segs, e)
                 }
+            } else if max_segs := synchron.timeshiftSegments(_target_duration); max_segs != max_timeshift_segs {
+                // Timeshift duration was reloaded.
+                log.Infof("Resize Timeshift playlist winsize from %d to %d \n", max_timeshift_segs, max_segs)
+                timeshift_playlist, timeshift_dseq = resizePlaylist(timeshift_playlist, max_segs, timeshift_dseq)
+                max_timeshift_segs = max_segs
             }
         }
         if nil == index_playlist {
@@ -114,32 +118,33 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
                 log.Errorf("Generate index playlist '%s' failed:> %s\n", fname, e)
             } else if fname != "" && exists(fname) {
                 // READ playlist.
-                if f, e := os.Open(fname); e != nil {
+                if index_playlist, _, e = synchron.readMediaPlaylist(fname); e != nil {
                     log.Errorf("Read previous index playlist '%s' failed:> %s\n", fname, e)
                 } else {
-                    if playlist, listType, err := m3u8.DecodeFrom(f, true,"", synchron.program_timezone); nil != err {
-                        log.Errorf("Decode previous index playlist '%s' failed:> %s\n", fname, err)
-                    } else {
-                        if listType == m3u8.MEDIA {
-                            index_playlist = playlist.(*m3u8.MediaPlaylist)
-                            for _, v := range index_playlist.Segments {
-                                if v != nil {
-                                    last_seg_timestamp = v.ProgramDateTime
-                                    if index_by == IDXT_MINUTE {
-                                        index = uint64(last_seg_timestamp.Second() / _target_duration)
-                                    } else {
-                                        index = uint64((segtime.Minute()*60 + segtime.Second()) / _target_duration)
-                                    }
-                                }
+                    for _, v := range index_playlist.Segments {
+                        if v != nil {
+                            last_seg_timestamp = v.ProgramDateTime
+                            last_seg = v
+                            if index_by == IDXT_MINUTE {
+                                index = uint64(last_seg_timestamp.Second() / _target_duration)
+                            } else {
+                                index = uint64((segtime.Minute()*60 + segtime.Second()) / _target_duration)
                             }
-                        } else {
-                            log.Warningf("Previous index playlist file '%s' is not a MediaPlaylist ???\n", fname)
                         }
                     }
-                    f.Close()
                 }
             }
         }
+        if nil != restored {
+            index = restored.Index
+            last_seg_timestamp = restored.LastTimestamp
+            last_seg_duration = time.Duration(restored.LastDuration)
+            last_seg = &m3u8.MediaSegment{ProgramDateTime: restored.LastTimestamp, Duration: restored.LastDuration}
+            if synchron.option.Record.Timeshifting {
+                timeshift_dseq = restored.TimeshiftDseq
+            }
+            restored = nil
+        }
         if index_by == IDXT_MINUTE {
             if segtime.Year() != last_seg_timestamp.Year() ||
                 segtime.Month() != last_seg_timestamp.Month() ||
@@ -188,8 +193,15 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
                 index = uint64((segtime.Minute()*60 + segtime.Second()) / _target_duration)
             }
         }
+        // Discontinuous from the source, or where the recording was interrupted.
+        discontinuity := msg.segment.Discontinuity || (nil != last_seg && isGap(last_seg, segtime))
+        last_seg = msg.segment
         log.Debugln("Recording segment:> ", msg.segment, msg.seg_buffer.Len())
         fname, e := synchron.generateFilename(synchron.option.Record.Output, synchron.option.Record.SegmentRewrite, msg.segment.ProgramDateTime, index+1)
+        if ext := segmentExt(msg.segment.URI, nil != msg.segment.Map); ext != filepath.Ext(fname) {
+            // Keep the container of source.
+            fname = strings.TrimSuffix(fname, filepath.Ext(fname)) + ext
+        }
         //log.Debugf("New filename:> %s <%s> \n", fname, e)
         log.Infof("Recording segment:> %s | %s | %s ...\n", msg.segment.URI, msg.segment.ProgramDateTime, fname)
         last_seg_timestamp = msg.segment.ProgramDateTime
@@ -198,8 +210,16 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
         e = os.MkdirAll(filepath.Dir(fname), 0777)
         if e != nil {
             log.Errorf("Create directory '%s' failed:> %s \n", filepath.Dir(fname), e)
+            synchron.writeResult("record", filepath.Dir(fname), e)
             continue
         }
+        if nil == msg.segment.Map {
+            init_file = ""
+        } else if nil != msg.init_buffer {
+            if init_file, e = writeInit(filepath.Dir(fname), msg.segment.Map.URI, msg.init_buffer.Bytes()); nil != e {
+                log.Errorf("Write initialization section '%s' failed:> %s \n", msg.segment.Map.URI, e)
+            }
+        }
         if exists(fname) {
             log.Warningf("Segment file <%s> exists! Skipped!", fname)
             continue
@@ -207,17 +227,20 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
         out, err := os.Create(fname)
         if err != nil {
             log.Errorf("Create segment file '%s' failed:> %s \n", fname, err)
-            return
+            synchron.writeResult("record", fname, err)
+            continue
         }
         n, e := msg.seg_buffer.WriteTo(out)
         if nil != e {
-            log.Errorf("Write to segment file '%s' failed:> %s \n", fname, err)
+            log.Errorf("Write to segment file '%s' failed:> %s \n", fname, e)
+            synchron.writeResult("record", fname, e)
             out.Close()
             continue
         } else {
             log.Debugf("Write to segment file '%s' bytes:> %d \n", fname, n)
         }
         out.Close()
+        synchron.writeResult("record", fname, nil)
         //last_seg_timestamp = msg.segment.ProgramDateTime
         //last_seg_duration = time.Duration(msg.segment.Duration)
         log.Infof("Recorded segment:> %s | %s | %s \n", msg.segment.URI, msg.segment.ProgramDateTime, fname)
@@ -229,7 +252,13 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
                 ProgramDateTime: msg.segment.ProgramDateTime,
                 Title:           msg.segment.URI,
                 SeqId:           index,
+                Discontinuity:   discontinuity,
             }
+            index_fname, _ := synchron.generateFilename(synchron.option.Record.Output, synchron.option.Record.ReindexFormat, segtime, 0)
+            if nil != msg.key {
+                seg.Key = synchron.playlistKey(msg.key, filepath.Dir(index_fname))
+            }
+            seg.Map = playlistMap(init_file, filepath.Dir(index_fname))
             if e := index_playlist.AppendSegment(&seg); nil == e {
                 synchron.saveIndexPlaylist(index_playlist)
             } else {
@@ -245,14 +274,21 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
                     ProgramDateTime: msg.segment.ProgramDateTime,
                     Title:           msg.segment.URI,
                     SeqId:           index,
+                    Key:             synchron.playlistKey(msg.key, synchron.option.Record.Output),
+                    Map:             playlistMap(init_file, synchron.option.Record.Output),
+                    Discontinuity:   discontinuity,
                 }
                 if timeshift_playlist.Count() >= max_timeshift_segs {
+                    // Removing a discontinuity increases the discontinuity sequence.
+                    if segments := segmentsInOrder(timeshift_playlist); len(segments) > 0 && segments[0].Discontinuity {
+                        timeshift_dseq++
+                    }
                     if e := timeshift_playlist.Remove(); nil != e {
                         log.Errorln("Remove segment from timeshift playlist failed:>", e)
                     }
                 }
                 if e := timeshift_playlist.AppendSegment(&seg); nil == e {
-                    synchron.saveTimeshiftPlaylist(timeshift_playlist)
+                    synchron.saveTimeshiftPlaylist(timeshift_playlist, timeshift_dseq)
                 } else {
                     log.Errorf("Append to timeshift playlist failed:> %s \n", e)
                 }
@@ -261,10 +297,24 @@ func (synchron *Synchronizer) recordProc(msgChan chan *RecordMessage) {
                 log.Errorf("Get relative path of '%s' failed:> %s \n", fname, e)
             }
         }
+        synchron.state.recorded(&recordState{
+            Index:         index,
+            LastTimestamp: last_seg_timestamp,
+            LastDuration:  msg.segment.Duration,
+            TimeshiftDseq: timeshift_dseq,
+        })
     }
+    // Recording ends on shutdown, the playlists are left open as recording goes on after restart.
+    if nil != index_playlist && index_playlist.Count() > 0 {
+        synchron.saveIndexPlaylist(index_playlist)
+    }
+    if nil != timeshift_playlist && timeshift_playlist.Count() > 0 {
+        synchron.saveTimeshiftPlaylist(timeshift_playlist, timeshift_dseq)
+    }
+    log.Infoln("Recording stopped.")
 }
 
-func (synchron *Synchronizer) saveTimeshiftPlaylist(playlist *m3u8.MediaPlaylist) {
+func (synchron *Synchronizer) saveTimeshiftPlaylist(playlist *m3u8.MediaPlaylist, discontinuity_seq uint64) {
     if nil == playlist || nil == playlist.Segments[0] {
         log.Errorln("Empty playlist !")
         return
@@ -279,21 +329,50 @@ func (synchron *Synchronizer) saveTimeshiftPlaylist(playlist *m3u8.MediaPlaylist
     out, err := os.Create(fname)
     if err != nil {
         log.Errorf("Create timeshift file '%s' failed:>  %s \n", fname, err)
+        synchron.writeResult("record", fname, err)
         return
     }
     defer out.Close()
     //playlist.SetWinSize(playlist.Count())
     playlist.Close()
-    buf := playlist.Encode()
+    buf := encodePlaylist(playlist, discontinuity_seq, nil, nil)
     n, e := io.Copy(out, buf)
     if nil != e {
         log.Errorf("Write timeshift file '%s' failed:> %s \n", fname, e)
+        synchron.writeResult("record", fname, e)
     } else {
         log.Debugf("Write timeshift file '%s' bytes:> %d \n", fname, n)
     }
     log.Infof("Updated timeshift playlist:> %s : %d \n", fname, playlist.Count())
 }
 
+func (synchron *Synchronizer) timeshiftSegments(target_duration int) uint {
+    return uint((time.Duration(synchron.timeshiftDuration()) * time.Hour) / (time.Second * time.Duration(target_duration)))
+}
+
+// resizePlaylist rebuilds playlist to hold max segments, the oldest ones beyond are removed as a sliding playlist does.
+func resizePlaylist(playlist *m3u8.MediaPlaylist, max uint, discontinuity_seq uint64) (*m3u8.MediaPlaylist, uint64) {
+    resized, e := m3u8.NewMediaPlaylist(max, max)
+    if nil != e {
+        log.Errorf("Resize playlist to %d failed:> %s \n", max, e)
+        return playlist, discontinuity_seq
+    }
+    segments := segmentsInOrder(playlist)
+    for ; uint(len(segments)) > max; segments = segments[1:] {
+        if segments[0].Discontinuity {
+            discontinuity_seq++
+        }
+        playlist.Remove()
+    }
+    resized.SeqNo = playlist.SeqNo
+    resized.TargetDuration = playlist.TargetDuration
+    resized.Closed = playlist.Closed
+    for _, v := range segments {
+        resized.AppendSegment(v)
+    }
+    return resized, discontinuity_seq
+}
+
 func (synchron *Synchronizer) saveIndexPlaylist(playlist *m3u8.MediaPlaylist) {
     if nil == playlist || nil == playlist.Segments[0] {
         log.Errorln("Empty playlist !")
@@ -309,14 +388,16 @@ func (synchron *Synchronizer) saveIndexPlaylist(playlist *m3u8.MediaPlaylist) {
     out, err := os.Create(fname)
     if err != nil {
         log.Errorf("Create index file '%s' failed:>  %s \n", fname, err)
+        synchron.writeResult("record", fname, err)
         return
     }
     defer out.Close()
     playlist.SetWinSize(playlist.Count())
-    buf := playlist.Encode()
+    buf := encodePlaylist(playlist, 0, nil, nil)
     n, e := io.Copy(out, buf)
     if nil != e {
         log.Errorf("Write index file '%s' failed:> %s \n", fname, e)
+        synchron.writeResult("record", fname, e)
     } else {
         log.Debugf("Write index file '%s' bytes:> %d \n", fname, n)
     }
@@ -0,0 +1,210 @@
+/**
+This source file contains the redundant capture which polls all sources and fills segments missing on one from others.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+	"github.com/golang/groupcache/lru"
+)
+
+type SourceMode uint8
+
+const (
+	SM_FAILOVER SourceMode = 1 + iota
+	SM_REDUNDANT
+)
+
+type AlignBy uint8
+
+const (
+	AB_PROGRAM AlignBy = 1 + iota
+	AB_SEQUENCE
+)
+
+// Program date times of the same segment from different origins are considered equal within this precision.
+const alignPrecision = 100 * time.Millisecond
+
+func parseSourceMode(s string) (SourceMode, error) {
+	switch strings.ToLower(s) {
+	case "", "failover":
+		return SM_FAILOVER, nil
+	case "redundant":
+		return SM_REDUNDANT, nil
+	}
+	return 0, fmt.Errorf("unknown source mode '%s'", s)
+}
+
+func parseAlignBy(s string) (AlignBy, error) {
+	switch strings.ToLower(s) {
+	case "", "program":
+		return AB_PROGRAM, nil
+	case "sequence":
+		return AB_SEQUENCE, nil
+	}
+	return 0, fmt.Errorf("unknown align by '%s'", s)
+}
+
+// alternate is the URL of a segment on one of the redundant sources.
+type alternate struct {
+	source int
+	uri    string
+	limit  int64 // Byte range of the segment on source.
+	offset int64
+	crypt  *segmentCrypt
+}
+
+// alternateSet keeps the URLs of recent segments on all redundant sources, keyed by segment key.
+type alternateSet struct {
+	sync.Mutex
+	alignBy AlignBy
+	cache   *lru.Cache
+}
+
+func newAlternateSet(alignBy AlignBy, size int) *alternateSet {
+	return &alternateSet{alignBy: alignBy, cache: lru.New(size)}
+}
+
+func (set *alternateSet) add(key string, source int, uri string, limit int64, offset int64, crypt *segmentCrypt) {
+	set.Lock()
+	defer set.Unlock()
+	var alts []alternate
+	if v, ok := set.cache.Get(key); ok {
+		alts = v.([]alternate)
+	}
+	for i, alt := range alts {
+		if alt.source == source {
+			alts[i].uri = uri
+			alts[i].limit, alts[i].offset = limit, offset
+			alts[i].crypt = crypt
+			return
+		}
+	}
+	set.cache.Add(key, append(alts, alternate{source: source, uri: uri, limit: limit, offset: offset, crypt: crypt}))
+}
+
+func (set *alternateSet) get(key string) []alternate {
+	set.Lock()
+	defer set.Unlock()
+	if v, ok := set.cache.Get(key); ok {
+		return append([]alternate(nil), v.([]alternate)...)
+	}
+	return nil
+}
+
+// segmentKey identifies a segment in the timestamp cache, see dedupKey. Segments of redundant sources are aligned by
+// PROGRAM-DATE-TIME or media sequence, falling back to media sequence when the source has no PROGRAM-DATE-TIME.
+func (synchron *Synchronizer) segmentKey(v *m3u8.MediaSegment, base *url.URL, seq sourceSequence) string {
+	if synchron.alternates == nil {
+		return synchron.dedupKey(v, base, seq)
+	}
+	if synchron.alternates.alignBy == AB_PROGRAM && v.ProgramDateTime.Year() >= 2016 {
+		return fmt.Sprintf("pdt:%d", v.ProgramDateTime.Round(alignPrecision).UnixNano())
+	}
+	return fmt.Sprintf("seq:%d", v.SeqId)
+}
+
+type polledPlaylist struct {
+	source int
+	mpl    *m3u8.MediaPlaylist
+	resp   *http.Response
+	seq    sourceSequence
+}
+
+// redundantProc polls all sources concurrently, a segment is taken from whichever source announces it first.
+func (synchron *Synchronizer) redundantProc(state *playlistState, segmentChan chan *SegmentMessage) {
+	polled := make(chan *polledPlaylist)
+	for idx := range synchron.option.Source.Urls {
+		idx := idx
+		go synchron.guard("sourcePoll", func() { synchron.pollSource(idx, polled) })
+	}
+	for {
+		select {
+		case p := <-polled:
+			synchron.handlePlaylist(state, p.source, p.mpl, p.resp, p.seq, nil, segmentChan)
+		case <-synchron.halt:
+			return
+		case <-synchron.quit:
+			return
+		}
+	}
+}
+
+func (synchron *Synchronizer) pollSource(idx int, polled chan *polledPlaylist) {
+	// Variants followed when the source is a master playlist.
+	variants := make(map[string]*resolvedVariant)
+	var ll *lowLatency
+	timer := &reloadTimer{}
+	for !synchron.halted() {
+		srcUrl := synchron.sourceURL(idx)
+		timer.start()
+		blocking := nil != ll && ll.canBlockReload
+		mpl, resp, loaded, seq, err := synchron.loadPlaylist(synchron.pollCtx, srcUrl, variants, ll)
+		ll = loaded
+		if err != nil {
+			log.Errorf("Load playlist failed:> %s : %s \n", srcUrl, err)
+			synchron.sourceDenied(idx, err)
+			delay := timer.failed()
+			synchron.sources.polled(idx, false, blocking, err, delay)
+			synchron.sources.playlistFailed(idx)
+			synchron.pause(delay)
+			continue
+		}
+		changed := timer.loaded(mpl, ll)
+		select {
+		case polled <- &polledPlaylist{source: idx, mpl: mpl, resp: resp, seq: seq}:
+		case <-synchron.halt:
+			return
+		case <-synchron.quit:
+			return
+		}
+		delay := timer.reloadDelay(mpl, ll, resp, changed)
+		synchron.sources.polled(idx, changed, blocking, nil, delay)
+		if mpl.Closed {
+			log.Errorf("Media Playlist closed:> %s \n", srcUrl)
+			synchron.sources.playlistFailed(idx)
+		}
+		synchron.pause(delay)
+	}
+}
+
+// downloadAlternate downloads a segment which failed on its source from other sources announcing it.
+// When no other source announced it yet, it waits a target duration for slower sources.
+func (synchron *Synchronizer) downloadAlternate(job *segmentJob) bool {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(time.Duration(job.msg._target_duration*1000) * time.Millisecond):
+			case <-synchron.quit:
+				return false
+			}
+		}
+		tried := false
+		for _, alt := range synchron.alternates.get(job.msg._key) {
+			if alt.source == job.msg._source {
+				continue
+			}
+			tried = true
+			log.Warningf("Downloading segment from backup source:> %s \n", alt.uri)
+			if data, err := synchron.downloadSegment(alt.uri, alt.limit, alt.offset); nil == err {
+				synchron.sources.segmentDownloaded(job.msg._source, false)
+				job.msg._source, job.msg._crypt, job.uri, job.data, job.err = alt.source, alt.crypt, alt.uri, data, nil
+				job.limit, job.offset = alt.limit, alt.offset
+				return true
+			}
+			synchron.sources.segmentDownloaded(alt.source, false)
+		}
+		if tried {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+/**
+This source file contains the scheduling of playlist reloads as RFC 8216 section 6.3.4, and the poll statistics of sources.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/archsh/go.m3u8"
+)
+
+const (
+	// Backoff of reloading after consecutive failures, doubled on each one up to the max.
+	reloadBackoffMin = time.Second
+	reloadBackoffMax = 30 * time.Second
+)
+
+// reloadTimer schedules the reloads of one source.
+type reloadTimer struct {
+	started     time.Time // When loading the latest playlist started.
+	failures    int       // Consecutive failures.
+	fingerprint string    // Of the latest playlist loaded, tells if it changed.
+}
+
+// reloadTimers keeps a reload timer for each source, so the backoff of a failed source does not delay another.
+type reloadTimers map[int]*reloadTimer
+
+func (timers reloadTimers) get(idx int) *reloadTimer {
+	timer, ok := timers[idx]
+	if !ok {
+		timer = &reloadTimer{}
+		timers[idx] = timer
+	}
+	return timer
+}
+
+// start marks the start of loading, delays are measured from it.
+func (timer *reloadTimer) start() {
+	timer.started = time.Now()
+}
+
+// loaded reports a playlist loaded, returns true if it changed since the previous load.
+func (timer *reloadTimer) loaded(mpl *m3u8.MediaPlaylist, ll *lowLatency) bool {
+	fingerprint := fmt.Sprintf("%d:%d", mpl.SeqNo, mpl.Count())
+	if segments := segmentsInOrder(mpl); len(segments) > 0 {
+		fingerprint += ":" + segments[len(segments)-1].URI
+	}
+	if nil != ll {
+		fingerprint += fmt.Sprintf(":%d:%d", ll.nextMSN, len(ll.parts))
+	}
+	timer.failures = 0
+	changed := fingerprint != timer.fingerprint
+	timer.fingerprint = fingerprint
+	return changed
+}
+
+// failed reports a failure of loading, returns the delay before retrying.
+func (timer *reloadTimer) failed() time.Duration {
+	backoff := reloadBackoffMin
+	for i := 0; i < timer.failures && backoff < reloadBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > reloadBackoffMax {
+		backoff = reloadBackoffMax
+	}
+	timer.failures++
+	// Jitter keeps pollers of the same origin from retrying all at once.
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// reloadDelay is the delay before reloading a playlist, measured from the start of its loading. It is the target
+// duration when the playlist changed, half of it when not. Sources supporting blocking reload hold the request until
+// the next part or segment is available, Low-Latency sources without it are reloaded by part target instead.
+// A playlist still fresh in caches by Cache-Control is not reloaded before it expires, up to the target duration.
+func (timer *reloadTimer) reloadDelay(mpl *m3u8.MediaPlaylist, ll *lowLatency, resp *http.Response, changed bool) time.Duration {
+	if nil != ll && ll.canBlockReload && changed {
+		return 0
+	}
+	target := mpl.TargetDuration
+	if nil != ll && ll.partTarget > 0 {
+		target = ll.partTarget
+	}
+	delay := time.Duration(target*1000) * time.Millisecond
+	if !changed {
+		delay /= 2
+	}
+	if fresh := freshness(resp); fresh > delay && (nil == ll || !ll.canBlockReload) {
+		delay = fresh
+		if max := time.Duration(mpl.TargetDuration*1000) * time.Millisecond; delay > max {
+			delay = max
+		}
+	}
+	delay -= time.Now().Sub(timer.started)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// freshness is how long a response stays fresh by Cache-Control max-age and Age, 0 when it is not cacheable.
+func freshness(resp *http.Response) time.Duration {
+	if nil == resp {
+		return 0
+	}
+	maxAge := -1
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			maxAge, _ = strconv.Atoi(directive[len("max-age="):])
+		}
+	}
+	if maxAge <= 0 {
+		return 0
+	}
+	age, _ := strconv.Atoi(resp.Header.Get("Age"))
+	if age >= maxAge {
+		return 0
+	}
+	return time.Duration(maxAge-age) * time.Second
+}
+
+// pause waits for d between polls, returns false if the synchronizer is halted or stopped meanwhile.
+func (synchron *Synchronizer) pause(d time.Duration) bool {
+	if d <= 0 {
+		return !synchron.halted()
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-synchron.halt:
+		return false
+	case <-synchron.quit:
+		return false
+	}
+}
+
+// PollStats is how often a source is polled.
+type PollStats struct {
+	Url        string    `json:"url"`
+	Active     bool      `json:"active"`
+	Polls      int64     `json:"polls"`     // Playlist loads, including failed ones.
+	Changed    int64     `json:"changed"`   // Loads finding the playlist changed.
+	Unchanged  int64     `json:"unchanged"` // Loads finding the playlist not changed.
+	Errors     int64     `json:"errors"`
+	Blocking   int64     `json:"blocking"` // Blocking reloads of Low-Latency HLS.
+	Probes     int64     `json:"probes"`   // Loads probing inactive sources.
+	LastPoll   time.Time `json:"last_poll"`
+	NextReload float64   `json:"next_reload"` // Seconds scheduled before the next reload.
+}
+
+// PollStats returns the poll statistics of all sources.
+func (synchron *Synchronizer) PollStats() []PollStats {
+	set := synchron.sources
+	set.Lock()
+	defer set.Unlock()
+	stats := make([]PollStats, len(set.sources))
+	for i, h := range set.sources {
+		stats[i] = h.polls
+		stats[i].Url = h.url
+		stats[i].Active = i == set.active && nil == synchron.alternates
+	}
+	return stats
+}
+
+// polled reports a poll of source, err is nil when the playlist was loaded. next is the delay before the next one.
+func (set *sourceSet) polled(idx int, changed bool, blocking bool, err error, next time.Duration) {
+	set.Lock()
+	defer set.Unlock()
+	h := set.at(idx)
+	if nil == h {
+		return
+	}
+	stats := &h.polls
+	stats.Polls++
+	stats.LastPoll = time.Now()
+	stats.NextReload = next.Seconds()
+	if blocking {
+		stats.Blocking++
+	}
+	if nil != err {
+		stats.Errors++
+	} else if changed {
+		stats.Changed++
+	} else {
+		stats.Unchanged++
+	}
+}
+
+// probed reports a probe of an inactive source.
+func (set *sourceSet) probed(idx int, err error) {
+	set.Lock()
+	defer set.Unlock()
+	h := set.at(idx)
+	if nil == h {
+		return
+	}
+	stats := &h.polls
+	stats.Probes++
+	stats.LastPoll = time.Now()
+	if nil != err {
+		stats.Errors++
+	}
+}
+
+// serveStats responds the poll statistics of sources in JSON.
+func (synchron *Synchronizer) serveStats(response http.ResponseWriter) {
+	body, _ := json.MarshalIndent(synchron.PollStats(), "", "  ")
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	response.Write(body)
+}
@@ -0,0 +1,456 @@
+/**
+This source file contains the re-segmentation of MPEG-TS: segments of source are cut again at random access points
+into segments of the target duration, listed in a synced playlist of their own.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+	"github.com/archsh/go.timefmt"
+)
+
+// Cuts are made when the target duration is reached within it, in 90kHz clock.
+const resegmentTolerance = 900
+
+// resegmentChunk is a segment of source pending to cut, by the index of its first packet pending.
+type resegmentChunk struct {
+	index    int
+	pdt      time.Time
+	pts      int64 // PTS of the first PES of the stream cut at, which starts at pdt.
+	hasPTS   bool
+	duration float64
+}
+
+// randomAccess is a PES which may start a segment, by the index of its first packet pending.
+type randomAccess struct {
+	index int
+	pts   int64
+}
+
+// resegmenter cuts TS segments of source at random access points of the video stream, or of the first audio stream
+// when there is no video, into segments of the target duration. Segments which can not be cut, like fMP4 or those
+// kept encrypted, are passed as they are. It is used by segmentProc only.
+type resegmenter struct {
+	synchron      *Synchronizer
+	target        float64 // Seconds, the target duration of source when 0.
+	packets       [][]byte
+	chunks        []*resegmentChunk
+	points        []*randomAccess
+	program       *tsProgram
+	psi           [][]byte // PAT and PMT, prepended to segments cut within segments of source.
+	pid           uint16   // Elementary stream cut at.
+	streamType    uint8
+	discontinuity bool // The next segment cut is discontinuous.
+	passed        bool // The last segment was passed as it is.
+	sequence      uint64
+	name          string // Filename of the last segment.
+	renamed       int
+	playlist      *m3u8.MediaPlaylist // Segments listed in the synced playlist.
+	dseq          uint64              // Discontinuity sequence of playlist.
+}
+
+func (synchron *Synchronizer) newResegmenter() *resegmenter {
+	r := &resegmenter{synchron: synchron, target: float64(synchron.option.Sync.ReSegmentDuration)}
+	size := uint(synchron.option.MaxSegments)
+	r.playlist, _ = m3u8.NewMediaPlaylist(size, size)
+	r.restore()
+	return r
+}
+
+// restore continues the synced playlist written before restart, so its media and discontinuity sequences do not go
+// backwards. The index cleaned by CleanFolder is not continued.
+func (r *resegmenter) restore() {
+	option := &r.synchron.option.Sync
+	fname := filepath.Join(option.Output, option.IndexName)
+	if !option.Enabled || !exists(fname) || (option.CleanFolder && len(r.synchron.state.syncedFiles()) < 1) {
+		return
+	}
+	mpl, dseq, e := r.synchron.readMediaPlaylist(fname)
+	if nil != e {
+		log.Errorf("Read synced playlist '%s' failed:> %s \n", fname, e)
+		return
+	}
+	segments := decodedSegments(mpl)
+	if len(segments) < 1 {
+		return
+	}
+	r.playlist.SeqNo, r.dseq = mpl.SeqNo, dseq
+	for ; len(segments) > r.synchron.option.MaxSegments; segments = segments[1:] {
+		if segments[0].Discontinuity {
+			r.dseq++
+		}
+		r.playlist.SeqNo++
+	}
+	for _, v := range segments {
+		r.playlist.AppendSegment(v)
+	}
+	r.sequence = r.playlist.SeqNo + uint64(len(segments)) - 1
+	last := segments[len(segments)-1]
+	r.name, _ = timefmt.Strftime(last.ProgramDateTime, r.synchron.sourceCrc16+"_%Y%m%d-%H%M%S")
+	if strings.HasPrefix(last.URI, r.name+"-") {
+		fmt.Sscanf(last.URI[len(r.name)+1:], "%d", &r.renamed)
+	}
+	// Segments pending to cut before restart are lost.
+	r.discontinuity = true
+	log.Infof("Continued synced playlist:> %s | %d segments | sequence %d \n", fname, len(segments), r.playlist.SeqNo)
+}
+
+// ptsDiff returns a - b of PTS wrapping at 33 bits.
+func ptsDiff(a, b int64) int64 {
+	d := (a - b) & (1<<33 - 1)
+	if d >= 1<<32 {
+		d -= 1 << 33
+	}
+	return d
+}
+
+func ptsDuration(d int64) time.Duration {
+	return time.Duration(d) * time.Second / 90000
+}
+
+// cuttable tells whether the segment of job is TS in clear, which can be cut.
+func (r *resegmenter) cuttable(job *segmentJob) bool {
+	crypt := job.msg._crypt
+	if nil != job.msg._map || len(job.plain) == 0 || job.plain[0] != tsSyncByte {
+		return false
+	}
+	return nil == crypt || (crypt.method == METHOD_AES128 && !r.synchron.option.Sync.KeepEncrypted)
+}
+
+// add takes a segment of source, and returns the segments to deliver: those cut meanwhile, or the segment itself
+// when it can not be cut.
+func (r *resegmenter) add(job *segmentJob) []*segmentJob {
+	segment := job.msg.segment
+	if r.target <= 0 {
+		r.target = math.Max(job.msg._target_duration, 1)
+	}
+	var cuts []*segmentJob
+	if segment.Discontinuity {
+		cuts = r.interrupt()
+		r.discontinuity = true
+	}
+	var packets [][]byte
+	e := errors.New("not TS in clear")
+	if r.cuttable(job) {
+		if packets, e = splitTS(job.plain); nil == e {
+			var changed bool
+			if changed, e = r.setProgram(packets); changed {
+				cuts = append(cuts, r.interrupt()...)
+			}
+		}
+	}
+	if nil != e {
+		log.Debugf("Segment '%s' is not cut:> %s \n", segment.URI, e)
+		cuts = append(cuts, r.interrupt()...)
+		// Segments passed follow segments cut, and the other way round, as discontinuities.
+		segment.Discontinuity = segment.Discontinuity || (!r.passed && r.sequence > 0)
+		r.passed, r.discontinuity = true, true
+		return append(cuts, job)
+	}
+	r.passed = false
+	list := collectPES(packets, map[uint16]bool{r.pid: true})
+	chunk := &resegmentChunk{pdt: segment.ProgramDateTime, duration: segment.Duration}
+	for _, pes := range list {
+		if chunk.pts, chunk.hasPTS = pes.pts(); chunk.hasPTS {
+			break
+		}
+	}
+	if r.jumped(chunk) {
+		log.Warningf("PTS jumped at segment '%s', cut as discontinuous. \n", segment.URI)
+		cuts = append(cuts, r.interrupt()...)
+	}
+	chunk.index = len(r.packets)
+	for _, pes := range list {
+		if pts, ok := pes.pts(); ok && r.randomAccess(packets, pes) {
+			r.points = append(r.points, &randomAccess{index: chunk.index + r.psiStart(packets, pes.slots[0]), pts: pts})
+		}
+	}
+	r.packets = append(r.packets, packets...)
+	r.chunks = append(r.chunks, chunk)
+	for job := r.cut(); nil != job; job = r.cut() {
+		cuts = append(cuts, job)
+	}
+	return cuts
+}
+
+// setProgram finds the stream to cut at in PAT and PMT of packets, the first video stream or the first audio stream.
+// Returns true when the stream changed, segments are not cut across.
+func (r *resegmenter) setProgram(packets [][]byte) (bool, error) {
+	program, e := parseProgram(packets)
+	if nil != e {
+		if nil != r.program {
+			// Program is carried by previous segments.
+			return false, nil
+		}
+		return false, e
+	}
+	found := false
+	var pid uint16
+	for _, p := range program.order {
+		switch program.streams[p] {
+		case ST_H264, ST_H264_ENC, ST_HEVC, ST_MPEG1_VIDEO, ST_MPEG2_VIDEO:
+			if !found {
+				pid, found = p, true
+			}
+		}
+	}
+	for _, p := range program.order {
+		if !found && isMediaStream(program.streams[p]) {
+			pid, found = p, true
+		}
+	}
+	if !found {
+		return false, errors.New("no media stream")
+	}
+	changed := nil != r.program && (pid != r.pid || program.streams[pid] != r.streamType)
+	r.program, r.pid, r.streamType = program, pid, program.streams[pid]
+	r.psi = nil
+	for _, p := range packets {
+		if tsPUSI(p) && (tsPID(p) == 0 || tsPID(p) == program.pmtPid) {
+			r.psi = append(r.psi, append([]byte(nil), p...))
+			if len(r.psi) == 2 {
+				break
+			}
+		}
+	}
+	return changed, nil
+}
+
+// psiStart moves the start of a segment back to the PAT and PMT right before it.
+func (r *resegmenter) psiStart(packets [][]byte, index int) int {
+	for index > 0 {
+		if pid := tsPID(packets[index-1]); pid != 0 && pid != r.program.pmtPid {
+			break
+		}
+		index--
+	}
+	return index
+}
+
+// randomAccess tells whether a PES of the stream cut at may start a segment: flagged by random access indicator, or
+// starting a key frame. PES of audio streams all do.
+func (r *resegmenter) randomAccess(packets [][]byte, pes *tsPES) bool {
+	if af := tsAdaptation(packets[pes.slots[0]]); len(af) > 1 && af[1]&0x40 != 0 {
+		return true
+	}
+	switch r.streamType {
+	case ST_H264, ST_H264_ENC, ST_HEVC, ST_MPEG1_VIDEO, ST_MPEG2_VIDEO:
+	default:
+		return true
+	}
+	n, e := pes.header()
+	if nil != e {
+		return false
+	}
+	// NAL units or start codes before the first picture tell.
+	data := pes.data[n:]
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		b := data[i+3]
+		switch r.streamType {
+		case ST_H264, ST_H264_ENC:
+			if t := b & 0x1f; t == 5 {
+				return true
+			} else if t >= 1 && t <= 4 {
+				return false
+			}
+		case ST_HEVC:
+			if t := (b >> 1) & 0x3f; t >= 16 && t <= 21 {
+				return true
+			} else if t < 16 {
+				return false
+			}
+		default:
+			if b == 0xb3 || b == 0xb8 {
+				// Sequence or GOP header.
+				return true
+			} else if b == 0x00 {
+				return false
+			}
+		}
+		i += 3
+	}
+	return false
+}
+
+// jumped tells whether PTS of chunk does not follow pending segments of source.
+func (r *resegmenter) jumped(chunk *resegmentChunk) bool {
+	if len(r.chunks) < 1 || !chunk.hasPTS {
+		return false
+	}
+	last := r.chunks[len(r.chunks)-1]
+	if !last.hasPTS {
+		return false
+	}
+	d := ptsDiff(chunk.pts, last.pts+int64(last.duration*90000))
+	limit := int64(math.Max(r.target, last.duration) * 2 * 90000)
+	return d > limit || d < -limit
+}
+
+// start returns PTS at the start of pending packets, false if unknown.
+func (r *resegmenter) start() (int64, bool) {
+	if len(r.points) > 0 && r.points[0].index == 0 {
+		return r.points[0].pts, true
+	}
+	for _, c := range r.chunks {
+		if c.hasPTS {
+			return c.pts, true
+		}
+	}
+	return 0, false
+}
+
+// cut returns a segment cut at the first random access point reaching the target duration, nil if there is none yet.
+func (r *resegmenter) cut() *segmentJob {
+	start, ok := r.start()
+	if !ok {
+		return nil
+	}
+	for _, p := range r.points {
+		if d := ptsDiff(p.pts, start); p.index > 0 && d >= int64(r.target*90000)-resegmentTolerance {
+			return r.take(p.index, ptsDuration(d).Seconds())
+		}
+	}
+	return nil
+}
+
+// interrupt cuts all pending packets as the last segment before a discontinuity, which ends with the last segment
+// of source.
+func (r *resegmenter) interrupt() []*segmentJob {
+	if len(r.packets) < 1 {
+		return nil
+	}
+	last := r.chunks[len(r.chunks)-1]
+	var duration float64
+	if start, ok := r.start(); ok && last.hasPTS {
+		duration = ptsDuration(ptsDiff(last.pts+int64(last.duration*90000), start)).Seconds()
+	}
+	if duration <= 0 {
+		for _, c := range r.chunks {
+			duration += c.duration
+		}
+	}
+	job := r.take(len(r.packets), duration)
+	r.discontinuity = true
+	return []*segmentJob{job}
+}
+
+// take cuts the first n pending packets as a segment of duration.
+func (r *resegmenter) take(n int, duration float64) *segmentJob {
+	// Timestamp follows the segment of source it starts in.
+	pdt := r.chunks[0].pdt
+	if start, ok := r.start(); ok && r.chunks[0].hasPTS {
+		pdt = pdt.Add(ptsDuration(ptsDiff(start, r.chunks[0].pts)))
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, (n+len(r.psi))*tsPacketSize))
+	if tsPID(r.packets[0]) != 0 {
+		for _, p := range r.psi {
+			buf.Write(p)
+		}
+	}
+	for _, p := range r.packets[:n] {
+		buf.Write(p)
+	}
+	// Segments of source cut within are kept with their timestamps, which still apply.
+	var chunks []*resegmentChunk
+	for i, c := range r.chunks {
+		end := len(r.packets)
+		if i+1 < len(r.chunks) {
+			end = r.chunks[i+1].index
+		}
+		if end > n {
+			c.index = int(math.Max(float64(c.index-n), 0))
+			chunks = append(chunks, c)
+		}
+	}
+	var points []*randomAccess
+	for _, p := range r.points {
+		if p.index >= n {
+			p.index -= n
+			points = append(points, p)
+		}
+	}
+	r.packets, r.chunks, r.points = r.packets[n:], chunks, points
+	r.sequence++
+	segment := &m3u8.MediaSegment{
+		SeqId:           r.sequence,
+		URI:             r.filename(pdt),
+		Duration:        duration,
+		ProgramDateTime: pdt,
+		Discontinuity:   r.discontinuity,
+	}
+	r.discontinuity = false
+	log.Infof("Cut segment:> %s | %f | %s \n", segment.URI, segment.Duration, segment.ProgramDateTime)
+	data := buf.Bytes()
+	msg := &SegmentMessage{_type: SEGMEMT, _target_duration: r.target, segment: segment}
+	return &segmentJob{msg: msg, data: data, plain: data}
+}
+
+// filename names a segment by its timestamp as segments of source are, suffixed when the name is taken.
+func (r *resegmenter) filename(pdt time.Time) string {
+	name, _ := timefmt.Strftime(pdt, r.synchron.sourceCrc16+"_%Y%m%d-%H%M%S")
+	if name == r.name {
+		r.renamed++
+		return fmt.Sprintf("%s-%d.ts", name, r.renamed)
+	}
+	r.name, r.renamed = name, 0
+	return name + ".ts"
+}
+
+// list adds a segment delivered to the synced playlist, and returns a copy of the playlist to sync.
+func (r *resegmenter) list(segment *m3u8.MediaSegment) *m3u8.MediaPlaylist {
+	if r.playlist.Count() >= uint(r.synchron.option.MaxSegments) {
+		// Removing a discontinuity increases the discontinuity sequence.
+		if segments := segmentsInOrder(r.playlist); len(segments) > 0 && segments[0].Discontinuity {
+			r.dseq++
+		}
+		r.playlist.Remove()
+	}
+	v := *segment
+	r.playlist.AppendSegment(&v)
+	segments := segmentsInOrder(r.playlist)
+	size := uint(len(segments))
+	mpl, _ := m3u8.NewMediaPlaylist(size, size)
+	mpl.SeqNo = r.playlist.SeqNo
+	for _, v := range segments {
+		if d := math.Ceil(v.Duration); d > mpl.TargetDuration {
+			mpl.TargetDuration = d
+		}
+		// Keys and initialization sections are set to the copy.
+		s := *v
+		mpl.AppendSegment(&s)
+	}
+	return mpl
+}
+
+// deliverCuts delivers segments of resegmenter, and syncs the playlist of them after each one.
+func (synchron *Synchronizer) deliverCuts(r *resegmenter, cuts []*segmentJob, syncChan chan *SyncMessage, recordChan chan *RecordMessage) {
+	for _, job := range cuts {
+		if !synchron.deliverSegment(job, syncChan, recordChan) || !synchron.option.Sync.Enabled {
+			continue
+		}
+		le_msg := &SyncMessage{}
+		le_msg._type = PLAYLIST
+		le_msg.playlist = r.list(job.msg.segment)
+		le_msg.discontinuity = r.dseq
+		if nil != synchron.encryptor {
+			synchron.applyKeys(le_msg.playlist)
+		}
+		synchron.applyMaps(le_msg.playlist)
+		select {
+		case syncChan <- le_msg:
+		case <-synchron.quit:
+		}
+	}
+}
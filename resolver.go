@@ -0,0 +1,207 @@
+/**
+This source file contains the resolving of source URLs which expire, like signed ones, by an external command or a
+local HTTP endpoint.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Source URLs are resolved again this long before their signature expires.
+	resolveAhead = time.Minute
+	// Min interval of resolving the same source, against sources denying continuously.
+	resolveMinInterval = 10 * time.Second
+)
+
+// SourceResolver returns a fresh URL of a source, given the source URL as configured.
+type SourceResolver func(source string) (string, error)
+
+// SetSourceResolver sets the resolver of source URLs, which replaces the one configured by option.
+func (synchron *Synchronizer) SetSourceResolver(resolver SourceResolver) {
+	synchron.sources.Lock()
+	defer synchron.sources.Unlock()
+	synchron.resolver = resolver
+}
+
+// httpStatusError is an unexpected HTTP status from source.
+type httpStatusError struct {
+	code int
+	what string
+}
+
+func (e *httpStatusError) Error() string {
+	if e.what != "" {
+		return fmt.Sprintf("received HTTP %d for %s", e.code, e.what)
+	}
+	return fmt.Sprintf("received HTTP %d", e.code)
+}
+
+// isDenied tells if err is source denying the request, which happens when a signed URL expired.
+func isDenied(err error) bool {
+	if e, ok := err.(*httpStatusError); ok {
+		return e.code == http.StatusUnauthorized || e.code == http.StatusForbidden
+	}
+	return false
+}
+
+// setupResolver sets the resolver configured, an http(s) URL is taken as endpoint, others as command.
+func (synchron *Synchronizer) setupResolver() {
+	resolver := synchron.option.Source.Resolver
+	if resolver == "" {
+		return
+	} else if strings.HasPrefix(resolver, "http://") || strings.HasPrefix(resolver, "https://") {
+		synchron.resolver = synchron.endpointResolver(resolver)
+	} else {
+		synchron.resolver = synchron.commandResolver(resolver)
+	}
+}
+
+// commandResolver runs command with the source URL as last argument, the first line it prints is the fresh URL.
+// The channel name is given by environment variable HLS_SYNC_CHANNEL.
+func (synchron *Synchronizer) commandResolver(command string) SourceResolver {
+	return func(source string) (string, error) {
+		args := append(strings.Fields(command), source)
+		ctx, cancel := context.WithTimeout(synchron.pollCtx, time.Duration(synchron.option.Timeout)*time.Second)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), "HLS_SYNC_CHANNEL="+synchron.name)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, e := cmd.Output()
+		if nil != e {
+			return "", fmt.Errorf("%s: %s", e, strings.TrimSpace(stderr.String()))
+		}
+		return firstLine(out)
+	}
+}
+
+// endpointResolver requests endpoint with query parameters 'source' and 'channel', the first line of response body
+// is the fresh URL.
+func (synchron *Synchronizer) endpointResolver(endpoint string) SourceResolver {
+	return func(source string) (string, error) {
+		u, e := url.Parse(endpoint)
+		if nil != e {
+			return "", e
+		}
+		q := u.Query()
+		q.Set("source", source)
+		q.Set("channel", synchron.name)
+		u.RawQuery = q.Encode()
+		client := &http.Client{Timeout: time.Duration(synchron.option.Timeout) * time.Second}
+		req, e := http.NewRequest("GET", u.String(), nil)
+		if nil != e {
+			return "", e
+		}
+		resp, e := client.Do(req.WithContext(synchron.pollCtx))
+		if nil != e {
+			return "", e
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return "", &httpStatusError{code: resp.StatusCode, what: "resolver"}
+		}
+		body, e := ioutil.ReadAll(resp.Body)
+		if nil != e {
+			return "", e
+		}
+		return firstLine(body)
+	}
+}
+
+func firstLine(out []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			return line, nil
+		}
+	}
+	return "", errors.New("resolver returned no URL")
+}
+
+// urlExpiry returns when the signature of a source URL expires by the configured query parameter, zero if unknown.
+func (synchron *Synchronizer) urlExpiry(urlStr string) time.Time {
+	param := synchron.option.Source.ExpiryParam
+	if param == "" {
+		return time.Time{}
+	}
+	u, e := url.Parse(urlStr)
+	if nil != e {
+		return time.Time{}
+	}
+	sec, e := strconv.ParseInt(u.Query().Get(param), 10, 64)
+	if nil != e {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// sourceURL returns the URL to request source idx with. The source is resolved at first, after it denied a request
+// and before its signature expires, the URL resolved last or configured is returned when resolving fails.
+func (synchron *Synchronizer) sourceURL(idx int) string {
+	set := synchron.sources
+	set.Lock()
+	h := set.at(idx)
+	if nil == h {
+		// Sources were replaced meanwhile, the active one is taken.
+		h = set.sources[set.active]
+	}
+	resolver := synchron.resolver
+	configured, current := h.url, h.resolved
+	need := nil != resolver && (current == "" || h.denied || (!h.expires.IsZero() && time.Now().After(h.expires.Add(-resolveAhead))))
+	need = need && time.Now().Sub(h.resolvedAt) >= resolveMinInterval
+	if need {
+		h.resolvedAt = time.Now()
+	}
+	set.Unlock()
+	if current == "" {
+		current = configured
+	}
+	if !need {
+		return current
+	}
+	fresh, e := resolver(configured)
+	if nil != e {
+		log.Errorf("Resolve source failed:> %s : %s \n", configured, e)
+		return current
+	}
+	expires := synchron.urlExpiry(fresh)
+	set.Lock()
+	h.resolved, h.denied, h.expires = fresh, false, expires
+	set.Unlock()
+	if expires.IsZero() {
+		log.Infof("Resolved source:> %s \n", configured)
+	} else {
+		log.Infof("Resolved source:> %s | expires %s \n", configured, expires)
+	}
+	return fresh
+}
+
+// sourceDenied marks source idx to be resolved again, when err is it denying a request.
+func (synchron *Synchronizer) sourceDenied(idx int, err error) {
+	if !isDenied(err) {
+		return
+	}
+	set := synchron.sources
+	set.Lock()
+	defer set.Unlock()
+	if h := set.at(idx); nil != h && nil != synchron.resolver && !h.denied {
+		log.Warningf("Source denied request, resolving it again:> %s : %s \n", h.url, err)
+		h.denied = true
+	}
+}
@@ -0,0 +1,192 @@
+/**
+This source file contains the capture state of a channel kept across restarts: segments delivered with their
+timestamps, segment files synced and the position of recorder.
+*/
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/archsh/go.m3u8"
+)
+
+// captureState is saved to the state file as JSON.
+type captureState struct {
+	Segments []*stateSegment `json:"segments"`         // Segments delivered, oldest first.
+	Synced   []string        `json:"synced,omitempty"` // Segment files synced, oldest first.
+	Record   *recordState    `json:"record,omitempty"`
+	Saved    time.Time       `json:"saved"`
+}
+
+// stateSegment is a knownSegment of the timestamp cache.
+type stateSegment struct {
+	Key           string    `json:"key"`
+	SeqId         uint64    `json:"seq"`
+	Timestamp     time.Time `json:"timestamp"`
+	Discontinuity bool      `json:"discontinuity,omitempty"`
+	Sequence      uint64    `json:"discontinuity_seq"`
+}
+
+// recordState is the position of recorder after the last segment recorded.
+type recordState struct {
+	Index         uint64    `json:"index"`
+	LastTimestamp time.Time `json:"last_timestamp"`
+	LastDuration  float64   `json:"last_duration"`
+	TimeshiftDseq uint64    `json:"timeshift_discontinuity_seq"`
+}
+
+// stateFile keeps the capture state and saves it on every change. A nil stateFile is disabled.
+type stateFile struct {
+	sync.Mutex
+	filename string
+	max      int // Max segments kept, as the timestamp cache.
+	state    captureState
+	restored bool
+}
+
+// outputDir returns the directory of files kept along with output, record output is preferred over sync output. Empty
+// if neither is enabled.
+func (synchron *Synchronizer) outputDir() string {
+	switch {
+	case synchron.option.Record.Enabled:
+		return synchron.option.Record.Output
+	case synchron.option.Sync.Enabled:
+		return synchron.option.Sync.Output
+	}
+	return ""
+}
+
+// setupState loads the state file in output directory. A state file failed to load is logged and replaced, capture
+// is not stopped by it.
+func (synchron *Synchronizer) setupState() {
+	name := synchron.option.StateFile
+	dir := synchron.outputDir()
+	if name == "" || dir == "" {
+		return
+	}
+	f := &stateFile{filename: filepath.Join(dir, name), max: synchron.option.MaxSegments}
+	synchron.state = f
+	data, e := ioutil.ReadFile(f.filename)
+	if os.IsNotExist(e) {
+		return
+	} else if nil != e {
+		log.Errorf("Read state file '%s' failed:> %s \n", f.filename, e)
+		return
+	}
+	if e = json.Unmarshal(data, &f.state); nil != e {
+		log.Errorf("Parse state file '%s' failed:> %s \n", f.filename, e)
+		f.state = captureState{}
+		return
+	}
+	f.restored = true
+	log.Infof("Restored capture state:> %s | %d segments | saved %s \n", f.filename, len(f.state.Segments), f.state.Saved)
+}
+
+// restore fills the timestamp cache of state with segments delivered before restart, returns the key of the last one.
+func (f *stateFile) restore(state *playlistState) string {
+	if nil == f {
+		return ""
+	}
+	f.Lock()
+	defer f.Unlock()
+	key := ""
+	for _, s := range f.state.Segments {
+		state.cache.Add(s.Key, &knownSegment{timestamp: s.Timestamp, discontinuity: s.Discontinuity, sequence: s.Sequence})
+		state.discontinuity = s.Sequence
+		key = s.Key
+	}
+	return key
+}
+
+// delivered keeps a segment which is downloaded and delivered to sync and record.
+func (f *stateFile) delivered(key string, v *m3u8.MediaSegment, sequence uint64) {
+	if nil == f {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.state.Segments = append(f.state.Segments, &stateSegment{
+		Key:           key,
+		SeqId:         v.SeqId,
+		Timestamp:     v.ProgramDateTime,
+		Discontinuity: v.Discontinuity,
+		Sequence:      sequence,
+	})
+	if len(f.state.Segments) > f.max {
+		f.state.Segments = f.state.Segments[len(f.state.Segments)-f.max:]
+	}
+	f.save()
+}
+
+// synced keeps a segment file synced, as many as the synced files removed by RemoveOld.
+func (f *stateFile) synced(uri string) {
+	if nil == f {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.state.Synced = append(f.state.Synced, uri)
+	if len(f.state.Synced) > f.max {
+		f.state.Synced = f.state.Synced[len(f.state.Synced)-f.max:]
+	}
+	f.save()
+}
+
+// syncedFiles returns segment files synced before restart.
+func (f *stateFile) syncedFiles() []string {
+	if nil == f || !f.restored {
+		return nil
+	}
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.state.Synced...)
+}
+
+// recorded keeps the position of recorder.
+func (f *stateFile) recorded(rs *recordState) {
+	if nil == f {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.state.Record = rs
+	f.save()
+}
+
+// recordPosition returns the position of recorder before restart, nil if unknown.
+func (f *stateFile) recordPosition() *recordState {
+	if nil == f || !f.restored {
+		return nil
+	}
+	f.Lock()
+	defer f.Unlock()
+	return f.state.Record
+}
+
+// save writes the state to a temporary file renamed over the state file, so it is never half written.
+func (f *stateFile) save() {
+	f.state.Saved = time.Now()
+	data, e := json.Marshal(&f.state)
+	if nil != e {
+		log.Errorf("Encode capture state failed:> %s \n", e)
+		return
+	}
+	if e = os.MkdirAll(filepath.Dir(f.filename), 0777); nil != e {
+		log.Errorf("Create directory '%s' failed:> %s \n", filepath.Dir(f.filename), e)
+		return
+	}
+	tmp := f.filename + ".tmp"
+	if e = ioutil.WriteFile(tmp, data, 0666); nil != e {
+		log.Errorf("Write state file '%s' failed:> %s \n", tmp, e)
+		return
+	}
+	if e = os.Rename(tmp, f.filename); nil != e {
+		log.Errorf("Rename state file '%s' failed:> %s \n", f.filename, e)
+	}
+}
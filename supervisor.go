@@ -0,0 +1,234 @@
+/**
+This source file contains the supervisor which runs multiple channels in one process.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// channelRunner keeps the running Synchronizer of a channel, which is replaced on restarting.
+type channelRunner struct {
+	sync.Mutex
+	name     string
+	option   *Option
+	http     bool
+	synchron *Synchronizer
+	stopped  bool // Shut down, the channel is neither run nor restarted any more.
+}
+
+func (runner *channelRunner) current() *Synchronizer {
+	runner.Lock()
+	defer runner.Unlock()
+	return runner.synchron
+}
+
+// next returns the Synchronizer to run, nil when the channel is shut down.
+func (runner *channelRunner) next() *Synchronizer {
+	runner.Lock()
+	defer runner.Unlock()
+	if runner.stopped {
+		return nil
+	}
+	return runner.synchron
+}
+
+// replace installs the Synchronizer restarting the channel, unless the channel is shut down.
+func (runner *channelRunner) replace(s *Synchronizer) bool {
+	runner.Lock()
+	defer runner.Unlock()
+	if runner.stopped {
+		return false
+	}
+	runner.synchron = s
+	return true
+}
+
+// stop marks the channel shut down and returns the Synchronizer to shut down.
+func (runner *channelRunner) stop() *Synchronizer {
+	runner.Lock()
+	defer runner.Unlock()
+	runner.stopped = true
+	return runner.synchron
+}
+
+type Supervisor struct {
+	option   *Option
+	channels []*channelRunner
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+func NewSupervisor(option *Option) (*Supervisor, error) {
+	supervisor := &Supervisor{option: option, quit: make(chan struct{})}
+	for _, channel := range option.Channels {
+		chOption := channel.Option
+		runner := &channelRunner{name: channel.Name, option: &chOption, http: chOption.Http.Enabled}
+		// HTTP service of channels is provided by the supervisor.
+		chOption.Http.Enabled = false
+		s, e := NewSynchronizer(runner.option)
+		if nil != e {
+			return nil, fmt.Errorf("channel '%s': %s", channel.Name, e)
+		}
+		s.name = channel.Name
+		runner.synchron = s
+		supervisor.channels = append(supervisor.channels, runner)
+	}
+	return supervisor, nil
+}
+
+func (supervisor *Supervisor) Run() {
+	log.Infof("Supervisor.Run > Starting %d channels ...\n", len(supervisor.channels))
+	var wg sync.WaitGroup
+	for _, runner := range supervisor.channels {
+		wg.Add(1)
+		go func(runner *channelRunner) {
+			supervisor.supervise(runner)
+			wg.Done()
+		}(runner)
+	}
+	if supervisor.option.Http.Enabled {
+		wg.Add(1)
+		go func() {
+			serveHttp(supervisor.option.Http.Listen, supervisor, supervisor.quit)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+// Shutdown stops the HTTP service and restarting of channels, and shuts down all channels within timeout.
+func (supervisor *Supervisor) Shutdown(timeout time.Duration) {
+	supervisor.quitOnce.Do(func() {
+		close(supervisor.quit)
+	})
+	for _, runner := range supervisor.channels {
+		runner.stop().Shutdown(timeout)
+	}
+}
+
+// Reload applies options of channels, matched by name, the same way as Synchronizer.Reload does. Paths of options
+// requiring a restart are prefixed with channel names, channels added or removed require a restart too. Nothing is
+// applied when any channel is invalid.
+func (supervisor *Supervisor) Reload(option *Option) ([]string, error) {
+	channels := make(map[string]*ChannelOption)
+	for _, channel := range option.Channels {
+		if e := checkOption(&channel.Option); nil != e {
+			return nil, fmt.Errorf("channel '%s': %s", channel.Name, e)
+		}
+		channels[channel.Name] = channel
+	}
+	var restart []string
+	// Options of the supervisor itself, others are applied by channels.
+	for _, name := range changedOptions(nil, "", reflect.ValueOf(supervisor.option).Elem(), reflect.ValueOf(option).Elem()) {
+		switch name {
+		case "LogFile", "RestartDelay", "RestartMaxDelay", "Http.Enabled", "Http.Listen":
+			restart = append(restart, name)
+		}
+	}
+	for _, runner := range supervisor.channels {
+		channel, ok := channels[runner.name]
+		if !ok {
+			restart = append(restart, fmt.Sprintf("channel '%s' removed", runner.name))
+			continue
+		}
+		delete(channels, runner.name)
+		chOption := channel.Option
+		if chOption.Http.Enabled != runner.http {
+			restart = append(restart, runner.name+".Http.Enabled")
+		}
+		chOption.Http.Enabled = false
+		changed, e := runner.current().Reload(&chOption)
+		if nil != e {
+			return nil, fmt.Errorf("channel '%s': %s", runner.name, e)
+		}
+		for _, name := range changed {
+			restart = append(restart, runner.name+"."+name)
+		}
+	}
+	for _, channel := range option.Channels {
+		if _, ok := channels[channel.Name]; ok {
+			restart = append(restart, fmt.Sprintf("channel '%s' added", channel.Name))
+		}
+	}
+	return restart, nil
+}
+
+// supervise runs a channel and restarts it with backoff when it stopped unexpectedly.
+func (supervisor *Supervisor) supervise(runner *channelRunner) {
+	minDelay := time.Duration(supervisor.option.RestartDelay) * time.Second
+	maxDelay := time.Duration(supervisor.option.RestartMaxDelay) * time.Second
+	if minDelay <= 0 {
+		minDelay = time.Second
+	}
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	delay := minDelay
+	for {
+		s := runner.next()
+		if s == nil {
+			return
+		}
+		started := time.Now()
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("Channel '%s' crashed:> %v \n", runner.name, r)
+				}
+			}()
+			log.Infof("Starting channel '%s' ...\n", runner.name)
+			s.Run()
+		}()
+		select {
+		case <-supervisor.quit:
+			return
+		default:
+		}
+		if time.Now().Sub(started) > maxDelay {
+			// It was running stable for a while, restart quickly.
+			delay = minDelay
+		}
+		log.Errorf("Channel '%s' stopped, restarting in %s ...\n", runner.name, delay)
+		select {
+		case <-time.After(delay):
+		case <-supervisor.quit:
+			return
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+		if s, e := NewSynchronizer(runner.option); nil != e {
+			log.Errorf("Create channel '%s' failed:> %s \n", runner.name, e)
+		} else {
+			s.name = runner.name
+			if !runner.replace(s) {
+				// Shut down while it was being created.
+				s.Stop()
+				return
+			}
+		}
+	}
+}
+
+// ServeHTTP dispatches requests by channel name, eg: GET /{channel}/?start={start-timestamp}&end={end-timestamp}
+func (supervisor *Supervisor) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	name := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/"), "/", 2)[0]
+	for _, runner := range supervisor.channels {
+		if runner.name == name && runner.http {
+			runner.current().ServeHTTP(response, request)
+			return
+		}
+	}
+	log.Debugln("Channel not found:> ", request.URL.Path)
+	response.Header().Set("Content-Type", "text/plain")
+	response.WriteHeader(404)
+	response.Write([]byte(fmt.Sprintf("Channel '%s' not found!\n", name)))
+}
@@ -20,17 +20,29 @@ type SyncType uint8
 const (
 	PLAYLIST SyncType = 1 + iota
 	SEGMEMT
+	PART // Partial segment of Low-Latency HLS.
 )
 
 type SyncMessage struct {
-	_type      SyncType
-	playlist   *m3u8.MediaPlaylist
-	segment    *m3u8.MediaSegment
-	seg_buffer *bytes.Buffer
+	_type         SyncType
+	playlist      *m3u8.MediaPlaylist
+	segment       *m3u8.MediaSegment
+	seg_buffer    *bytes.Buffer
+	init_buffer   *bytes.Buffer   // Initialization section of segment when changed.
+	discontinuity uint64          // Discontinuity sequence of playlist.
+	parts         *lowLatency     // Partial segments of playlist, nil if not republished.
+	gaps          map[string]bool // Segments of playlist failed to download, by URI.
 }
 
 func (synchron *Synchronizer) syncProc(msgChan chan *SyncMessage) {
 	cache := lru.New(synchron.option.MaxSegments)
+	// Partial segments are only useful at live edge, old ones are always removed.
+	parts := lru.New(synchron.option.MaxSegments * 8)
+	parts.OnEvicted = func(k lru.Key, v interface{}) {
+		if err := os.Remove(v.(string)); err != nil {
+			log.Errorf("Delete file '%s' failed:> %s \n", v.(string), err)
+		}
+	}
 
 	if synchron.option.Sync.RemoveOld {
 		cache.OnEvicted = func(k lru.Key, v interface{}) {
@@ -43,13 +55,28 @@ func (synchron *Synchronizer) syncProc(msgChan chan *SyncMessage) {
 			}
 		}
 	}
+	if e := os.MkdirAll(synchron.option.Sync.Output, 0777); nil != e {
+		log.Errorf("Create directory '%s' failed:> %s \n", synchron.option.Sync.Output, e)
+	}
+	// The state file and gap log are kept along with output.
+	keep := map[string]bool{
+		synchron.option.StateFile:          true,
+		synchron.option.StateFile + ".tmp": true,
+		synchron.option.GapLog:             true,
+	}
+	// Segments synced before restart are still in the synced playlist, they are kept until evicted.
+	for _, uri := range synchron.state.syncedFiles() {
+		keep[uri] = true
+		keep[synchron.option.Sync.IndexName] = true
+		cache.Add(uri, filepath.Join(synchron.option.Sync.Output, uri))
+	}
 	if synchron.option.Sync.CleanFolder && synchron.option.Sync.Output != "" && synchron.option.Sync.Output != "." && synchron.option.Sync.Output != "/" {
 		// Clean target folder first.
 		if filenames, e := ioutil.ReadDir(synchron.option.Sync.Output); nil != e {
 			log.Errorf("Failed to open folder '%s' :> %s \n", synchron.option.Sync.Output, e)
 		} else {
 			for _, finfo := range filenames {
-				if finfo.IsDir() {
+				if finfo.IsDir() || keep[finfo.Name()] {
 					continue
 				}
 				fname := filepath.Join(synchron.option.Sync.Output, finfo.Name())
@@ -74,13 +101,15 @@ func (synchron *Synchronizer) syncProc(msgChan chan *SyncMessage) {
 			out, err := os.Create(filename)
 			if err != nil {
 				log.Errorf("Create playlist file '%s' failed:> %s \n", filename, err)
+				synchron.writeResult("sync", filename, err)
 				continue
 			}
 			_ = msg.playlist.SetWinSize(msg.playlist.Count())
-			buf := msg.playlist.Encode()
+			buf := encodePlaylist(msg.playlist, msg.discontinuity, msg.parts, msg.gaps)
 			log.Debugln("Writing playlist in bytes:", buf.Len(), msg.playlist.WinSize())
 			if n, e := io.Copy(out, buf); nil != e {
 				log.Errorf("Write playlist '%s' failed:> %s \n", filename, e)
+				synchron.writeResult("sync", filename, e)
 			} else {
 				log.Debugln("Wrote playlist in bytes:", n)
 			}
@@ -93,10 +122,16 @@ func (synchron *Synchronizer) syncProc(msgChan chan *SyncMessage) {
 			log.Infof("Synced playlist:> %s \n", filename)
 		case SEGMEMT:
 			log.Debugln("Syncing segment:> ", msg.segment.URI, msg.seg_buffer.Len())
+			if nil != msg.init_buffer {
+				if _, e := writeInit(synchron.option.Sync.Output, msg.segment.Map.URI, msg.init_buffer.Bytes()); nil != e {
+					log.Errorf("Write initialization section '%s' failed:> %s \n", msg.segment.Map.URI, e)
+				}
+			}
 			filename := filepath.Join(synchron.option.Sync.Output, msg.segment.URI)
 			out, err := os.Create(filename)
 			if err != nil {
 				log.Errorf("Create file '%s' failed:> %s \n", filename, err)
+				synchron.writeResult("sync", filename, err)
 				continue
 			}
 			n, e := msg.seg_buffer.WriteTo(out)
@@ -105,9 +140,20 @@ func (synchron *Synchronizer) syncProc(msgChan chan *SyncMessage) {
 			} else {
 				log.Debugf("Write segment file '%s' bytes:> %d \n", filename, n)
 			}
+			synchron.writeResult("sync", filename, e)
 			cache.Add(msg.segment.URI, filename)
+			synchron.state.synced(msg.segment.URI)
 			out.Close()
 			log.Infof("Synced segment:> %s | %f | %s | %s \n", msg.segment.URI, msg.segment.Duration, msg.segment.ProgramDateTime, filename)
+		case PART:
+			filename := filepath.Join(synchron.option.Sync.Output, msg.segment.URI)
+			if e := ioutil.WriteFile(filename, msg.seg_buffer.Bytes(), 0666); nil != e {
+				log.Errorf("Write partial segment file '%s' failed:> %s \n", filename, e)
+				synchron.writeResult("sync", filename, e)
+				continue
+			}
+			parts.Add(msg.segment.URI, filename)
+			log.Debugf("Synced partial segment:> %s | %f \n", msg.segment.URI, msg.segment.Duration)
 		}
 	}
 }
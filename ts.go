@@ -0,0 +1,353 @@
+/**
+This source file contains the MPEG-TS packet, PSI and PES processing shared by segment processors.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// Stream types of PMT.
+const (
+	ST_MPEG1_VIDEO  = 0x01
+	ST_MPEG2_VIDEO  = 0x02
+	ST_MPEG1_AUDIO  = 0x03
+	ST_MPEG2_AUDIO  = 0x04
+	ST_AAC_ADTS     = 0x0f
+	ST_AAC_LATM     = 0x11
+	ST_H264         = 0x1b
+	ST_HEVC         = 0x24
+	ST_AC3          = 0x81
+	ST_EAC3         = 0x87
+	ST_AAC_ADTS_ENC = 0xcf // SAMPLE-AES encrypted AAC.
+	ST_H264_ENC     = 0xdb // SAMPLE-AES encrypted H.264.
+)
+
+// isMediaStream tells whether the stream type carries audio or video.
+func isMediaStream(st uint8) bool {
+	switch st {
+	case ST_MPEG1_VIDEO, ST_MPEG2_VIDEO, ST_MPEG1_AUDIO, ST_MPEG2_AUDIO, ST_AAC_ADTS, ST_AAC_LATM, ST_H264, ST_HEVC,
+		ST_AC3, ST_EAC3, ST_AAC_ADTS_ENC, ST_H264_ENC:
+		return true
+	}
+	return false
+}
+
+// splitTS splits a TS segment into packets, which share the memory of data.
+func splitTS(data []byte) ([][]byte, error) {
+	if len(data) == 0 || len(data)%tsPacketSize != 0 {
+		return nil, fmt.Errorf("TS size %d is not multiple of %d", len(data), tsPacketSize)
+	}
+	packets := make([][]byte, 0, len(data)/tsPacketSize)
+	for i := 0; i < len(data); i += tsPacketSize {
+		if data[i] != tsSyncByte {
+			return nil, fmt.Errorf("lost TS sync byte at %d", i)
+		}
+		packets = append(packets, data[i:i+tsPacketSize])
+	}
+	return packets, nil
+}
+
+func tsPID(p []byte) uint16 {
+	return uint16(p[1]&0x1f)<<8 | uint16(p[2])
+}
+
+func tsPUSI(p []byte) bool {
+	return p[1]&0x40 != 0
+}
+
+// tsAdaptation returns the adaptation field of packet including its length byte, nil if absent.
+func tsAdaptation(p []byte) []byte {
+	if p[3]&0x20 == 0 {
+		return nil
+	}
+	end := 5 + int(p[4])
+	if end > tsPacketSize {
+		return nil
+	}
+	return p[4:end]
+}
+
+// tsPayload returns the payload of packet, nil if absent.
+func tsPayload(p []byte) []byte {
+	if p[3]&0x10 == 0 {
+		return nil
+	}
+	offset := 4 + len(tsAdaptation(p))
+	if offset >= tsPacketSize {
+		return nil
+	}
+	return p[offset:]
+}
+
+// tsProgram is the first program of a TS segment.
+type tsProgram struct {
+	pmtPid  uint16
+	streams map[uint16]uint8 // Stream types by elementary PID.
+	order   []uint16         // Elementary PIDs in order of PMT.
+}
+
+// psiSection returns the PSI section starting in payload of a packet.
+func psiSection(p []byte) ([]byte, error) {
+	payload := tsPayload(p)
+	if len(payload) < 1 || 1+int(payload[0])+3 > len(payload) {
+		return nil, errors.New("invalid PSI pointer")
+	}
+	section := payload[1+int(payload[0]):]
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if length < 4 || 3+length > len(section) {
+		return nil, errors.New("PSI section spans packets")
+	}
+	return section[:3+length], nil
+}
+
+// parseProgram finds PAT and PMT in packets.
+func parseProgram(packets [][]byte) (*tsProgram, error) {
+	program := &tsProgram{streams: make(map[uint16]uint8)}
+	found := false
+	for _, p := range packets {
+		if !tsPUSI(p) {
+			continue
+		}
+		pid := tsPID(p)
+		if pid == 0 && !found {
+			section, e := psiSection(p)
+			if nil != e {
+				return nil, e
+			}
+			// Program loop follows 8 bytes header, CRC32 excluded.
+			for i := 8; i+4 <= len(section)-4; i += 4 {
+				if number := uint16(section[i])<<8 | uint16(section[i+1]); number != 0 {
+					program.pmtPid = uint16(section[i+2]&0x1f)<<8 | uint16(section[i+3])
+					found = true
+					break
+				}
+			}
+		} else if found && pid == program.pmtPid {
+			section, e := psiSection(p)
+			if nil != e {
+				return nil, e
+			}
+			if len(section) < 16 {
+				return nil, errors.New("PMT too short")
+			}
+			i := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+			for i+5 <= len(section)-4 {
+				pid := uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2])
+				program.streams[pid] = section[i]
+				program.order = append(program.order, pid)
+				i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+			}
+			return program, nil
+		}
+	}
+	return nil, errors.New("PAT or PMT not found")
+}
+
+// tsPES is a PES packet of an elementary stream collected from TS packets.
+type tsPES struct {
+	pid   uint16
+	slots []int // Indexes of TS packets carrying the PES.
+	data  []byte
+}
+
+// header returns length of PES header, payload of the PES follows it.
+func (pes *tsPES) header() (int, error) {
+	if len(pes.data) < 9 || pes.data[0] != 0 || pes.data[1] != 0 || pes.data[2] != 1 {
+		return 0, errors.New("invalid PES start code")
+	}
+	n := 9 + int(pes.data[8])
+	if n > len(pes.data) {
+		return 0, errors.New("invalid PES header length")
+	}
+	return n, nil
+}
+
+// pts returns the presentation timestamp of PES in 90kHz clock.
+func (pes *tsPES) pts() (int64, bool) {
+	if n, e := pes.header(); nil != e || n < 14 || pes.data[7]&0x80 == 0 {
+		return 0, false
+	}
+	b := pes.data[9:14]
+	return int64(b[0]&0x0e)<<29 | int64(b[1])<<22 | int64(b[2]&0xfe)<<14 | int64(b[3])<<7 | int64(b[4])>>1, true
+}
+
+// collectPES collects PES packets of the elementary streams in pids.
+func collectPES(packets [][]byte, pids map[uint16]bool) []*tsPES {
+	var list []*tsPES
+	current := make(map[uint16]*tsPES)
+	for i, p := range packets {
+		pid := tsPID(p)
+		if !pids[pid] {
+			continue
+		}
+		payload := tsPayload(p)
+		if nil == payload {
+			// Packets carrying only adaptation field (PCR) are kept as they are.
+			continue
+		}
+		if tsPUSI(p) {
+			pes := &tsPES{pid: pid}
+			current[pid] = pes
+			list = append(list, pes)
+		}
+		if pes, ok := current[pid]; ok {
+			pes.slots = append(pes.slots, i)
+			pes.data = append(pes.data, payload...)
+		}
+	}
+	return list
+}
+
+// stuffAdaptation adds n stuffing bytes to an adaptation field, which is created when af is nil.
+func stuffAdaptation(af []byte, n int) []byte {
+	if n <= 0 {
+		return af
+	}
+	var out []byte
+	switch {
+	case nil == af && n == 1:
+		return []byte{0}
+	case nil == af:
+		out = []byte{byte(n - 1), 0}
+		n -= 2
+	case af[0] == 0:
+		// Empty adaptation field has no flags byte yet.
+		out = []byte{byte(n), 0}
+		n--
+	default:
+		out = append([]byte{byte(int(af[0]) + n)}, af[1:]...)
+	}
+	for ; n > 0; n-- {
+		out = append(out, 0xff)
+	}
+	return out
+}
+
+// packetizePES puts data of a PES into TS packets, reusing headers and adaptation fields of its original packets.
+// Extra packets are added when the PES grows, stuffing is added to the last packet.
+func packetizePES(packets [][]byte, pes *tsPES) [][]byte {
+	var out [][]byte
+	data := pes.data
+	for j := 0; len(data) > 0 || j == 0; j++ {
+		p := make([]byte, tsPacketSize)
+		var af []byte
+		if j < len(pes.slots) {
+			template := packets[pes.slots[j]]
+			copy(p[:4], template[:4])
+			af = tsAdaptation(template)
+			if j > 0 && nil != af && (len(af) < 2 || af[1] == 0) {
+				// Adaptation field of following packets is only stuffing, it is recalculated.
+				af = nil
+			}
+		} else {
+			copy(p[:4], packets[pes.slots[len(pes.slots)-1]][:4])
+			p[1] &^= 0x40
+		}
+		capacity := tsPacketSize - 4 - len(af)
+		if len(data) < capacity {
+			af = stuffAdaptation(af, capacity-len(data))
+			capacity = len(data)
+		}
+		p[3] &^= 0x30
+		p[3] |= 0x10
+		if nil != af {
+			p[3] |= 0x20
+			copy(p[4:], af)
+		}
+		copy(p[4+len(af):], data[:capacity])
+		data = data[capacity:]
+		out = append(out, p)
+	}
+	return out
+}
+
+// rebuildTS replaces the packets of modified PES, continuity counters of their PIDs are renumbered.
+func rebuildTS(packets [][]byte, modified []*tsPES) []byte {
+	first := make(map[int]*tsPES)
+	skip := make(map[int]bool)
+	pids := make(map[uint16]bool)
+	for _, pes := range modified {
+		first[pes.slots[0]] = pes
+		for _, i := range pes.slots[1:] {
+			skip[i] = true
+		}
+		pids[pes.pid] = true
+	}
+	out := make([]byte, 0, (len(packets)+len(packets)/16)*tsPacketSize)
+	counters := make(map[uint16]byte)
+	started := make(map[uint16]bool)
+	for i, p := range packets {
+		if skip[i] {
+			continue
+		}
+		list := [][]byte{p}
+		if pes, ok := first[i]; ok {
+			list = packetizePES(packets, pes)
+		}
+		for _, q := range list {
+			if pid := tsPID(q); pids[pid] {
+				if !started[pid] {
+					counters[pid] = q[3] & 0x0f
+					started[pid] = true
+				} else if q[3]&0x10 != 0 {
+					counters[pid] = (counters[pid] + 1) & 0x0f
+				}
+				q = append([]byte(nil), q...)
+				q[3] = q[3]&0xf0 | counters[pid]
+			}
+			out = append(out, q...)
+		}
+	}
+	return out
+}
+
+var crc32MpegTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32Mpeg is the CRC32 of PSI sections.
+func crc32Mpeg(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crc32MpegTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// writeSection writes a PSI section into the payload of a packet, the length and CRC32 of section are updated.
+func writeSection(p []byte, section []byte) error {
+	length := len(section) + 4 - 3
+	section[1] = section[1]&0xf0 | byte(length>>8)&0x0f
+	section[2] = byte(length)
+	crc := crc32Mpeg(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	offset := 4 + len(tsAdaptation(p))
+	if offset+1+len(section) > tsPacketSize {
+		return errors.New("PSI section exceeds a packet")
+	}
+	p[offset] = 0 // Pointer field.
+	copy(p[offset+1:], section)
+	for i := offset + 1 + len(section); i < tsPacketSize; i++ {
+		p[i] = 0xff
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+/**
+This source file contains the validation of downloaded segments: TS packets, fMP4 boxes and PTS span.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+
+	"github.com/archsh/go.m3u8"
+)
+
+// invalidSegment is a segment downloaded with invalid content.
+type invalidSegment struct {
+	reason string
+}
+
+func (e *invalidSegment) Error() string {
+	return "invalid segment: " + e.reason
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return &invalidSegment{reason: fmt.Sprintf(format, args...)}
+}
+
+// Top level boxes of fMP4 segments and initialization sections.
+var mp4Boxes = map[string]bool{
+	"ftyp": true, "styp": true, "moov": true, "moof": true, "mdat": true, "sidx": true, "emsg": true, "prft": true,
+	"free": true, "skip": true, "uuid": true,
+}
+
+// validateSegment validates a segment by its container, which is told by content or URI. Segments of other containers,
+// like WebVTT, are only checked not to be empty or an HTML page.
+func (synchron *Synchronizer) validateSegment(job *segmentJob) error {
+	data := job.plain
+	if len(data) == 0 {
+		return invalidf("empty")
+	}
+	ext := ""
+	if u, e := url.Parse(job.uri); nil == e {
+		ext = path.Ext(u.Path)
+	}
+	switch {
+	case data[0] == tsSyncByte || ext == ".ts":
+		packets, e := splitTS(data)
+		if nil != e {
+			return invalidf("%s", e)
+		}
+		if synchron.option.Download.CheckDuration && nil != job.msg.segment && job.msg._type == SEGMEMT {
+			return checkDuration(packets, job.msg.segment.Duration)
+		}
+	case nil != job.msg._map || (len(data) >= 8 && mp4Boxes[string(data[4:8])]) || ext == ".m4s" || ext == ".mp4":
+		return validateMP4(data)
+	default:
+		head := bytes.ToLower(bytes.TrimSpace(data[:int(math.Min(float64(len(data)), 512))]))
+		if bytes.HasPrefix(head, []byte("<!doctype html")) || bytes.HasPrefix(head, []byte("<html")) {
+			return invalidf("HTML page")
+		}
+	}
+	return nil
+}
+
+// validateMP4 checks that top level boxes cover the data exactly, and a media segment has both moof and mdat.
+func validateMP4(data []byte) error {
+	found := make(map[string]bool)
+	for i := 0; i < len(data); {
+		if len(data)-i < 8 {
+			return invalidf("truncated box header at %d", i)
+		}
+		size := uint64(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		header := uint64(8)
+		if size == 1 {
+			if len(data)-i < 16 {
+				return invalidf("truncated box header at %d", i)
+			}
+			size = binary.BigEndian.Uint64(data[i+8:])
+			header = 16
+		} else if size == 0 {
+			// Box extends to the end.
+			size = uint64(len(data) - i)
+		}
+		if !mp4Boxes[typ] {
+			return invalidf("unknown box %q at %d", typ, i)
+		}
+		if size < header || size > uint64(len(data)-i) {
+			return invalidf("box '%s' of size %d exceeds data at %d", typ, size, i)
+		}
+		found[typ] = true
+		i += int(size)
+	}
+	if found["moof"] && !found["mdat"] {
+		return invalidf("moof without mdat")
+	}
+	return nil
+}
+
+// Tolerance of PTS span against EXTINF duration, the larger of them.
+const (
+	durationTolerance      = 0.5 // Seconds.
+	durationToleranceRatio = 0.2 // Of EXTINF duration.
+)
+
+// checkDuration checks that the PTS span of the first media stream in TS packets matches duration. The span is
+// extended by the average interval of its PES, as the last frame lasts till the end of the segment.
+func checkDuration(packets [][]byte, duration float64) error {
+	program, e := parseProgram(packets)
+	if nil != e {
+		return invalidf("%s", e)
+	}
+	var pid uint16
+	found := false
+	for _, p := range program.order {
+		if isMediaStream(program.streams[p]) {
+			pid, found = p, true
+			break
+		}
+	}
+	if !found {
+		return invalidf("no media stream")
+	}
+	var first, last int64
+	n := 0
+	for _, pes := range collectPES(packets, map[uint16]bool{pid: true}) {
+		pts, ok := pes.pts()
+		if !ok {
+			continue
+		}
+		if n == 0 {
+			first, last = pts, pts
+		} else {
+			// PTS wraps at 33 bits, it goes below first by frame reordering too.
+			if first-pts > 1<<32 {
+				pts += 1 << 33
+			}
+			if pts > last {
+				last = pts
+			}
+		}
+		n++
+	}
+	if n < 2 {
+		return nil
+	}
+	span := float64(last-first) / 90000 * float64(n) / float64(n-1)
+	tolerance := math.Max(durationTolerance, duration*durationToleranceRatio)
+	if math.Abs(span-duration) > tolerance {
+		return invalidf("PTS span %.3fs does not match duration %.3fs", span, duration)
+	}
+	return nil
+}
+
+// gapsOf returns the segments of playlist failed to download.
+func (synchron *Synchronizer) gapsOf(mpl *m3u8.MediaPlaylist) map[string]bool {
+	var gaps map[string]bool
+	for _, v := range segmentsInOrder(mpl) {
+		if _, ok := synchron.gaps.Get(v.URI); ok {
+			if nil == gaps {
+				gaps = make(map[string]bool)
+			}
+			gaps[v.URI] = true
+		}
+	}
+	return gaps
+}